@@ -0,0 +1,191 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: who is calling
+
+Callers are identified by the attributes of their transaction certificate,
+never by IDs passed as arguments. The enrollmentId attribute names the
+caller, and is what actors, requesters and registrators are compared with
+and recorded as. Callers holding the admin role attribute administer the
+registry.
+
+The registrator of a record is the caller who registered it, whatever the
+record says. A person or company acts for itself only through the enrollment
+ID an admin binds to its record with bindEnrollment; record IDs are derived
+from names and never identify a caller.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Certificate attribute holding the enrollment ID of the caller
+var callerIDAttribute = "enrollmentId"
+
+// Certificate attribute a caller needs to administer the registry
+var adminRoleAttribute = "role"
+var adminRole = "admin"
+
+// callerID returns the enrollment ID of the caller
+func callerID(stub *shim.ChaincodeStub) (string, error) {
+	id, err := stub.ReadCertAttribute(callerIDAttribute)
+	if err != nil || len(id) == 0 {
+		return "", errors.New("The caller's certificate has no " + callerIDAttribute + " attribute")
+	}
+	return string(id), nil
+}
+
+// isAdmin reports whether the caller holds the admin role attribute
+func isAdmin(stub *shim.ChaincodeStub) bool {
+	ok, err := stub.VerifyAttribute(adminRoleAttribute, []byte(adminRole))
+	return err == nil && ok
+}
+
+// checkAdmin rejects callers without the admin role attribute and returns the
+// enrollment ID of the admin
+func checkAdmin(stub *shim.ChaincodeStub) (string, error) {
+	if !isAdmin(stub) {
+		return "", errors.New("Only an admin can do this")
+	}
+	return callerID(stub)
+}
+
+// isSubject reports whether the caller is the person or company itself, by
+// the enrollment ID bound to its record
+func isSubject(caller string, enrollmentID string) bool {
+	return enrollmentID != "" && caller == enrollmentID
+}
+
+// isSubjectOrRegistrator reports whether the caller is the subject of a record
+// or its registrator
+func isSubjectOrRegistrator(caller string, enrollmentID string, registrator string) bool {
+	return isSubject(caller, enrollmentID) || (registrator != "" && caller == registrator)
+}
+
+// checkRegistrator sets the registrator of a new record to the caller. A
+// record naming another registrator, or binding an enrollment ID, is rejected.
+func checkRegistrator(stub *shim.ChaincodeStub, registrator *string, enrollmentID string) error {
+	caller, err := callerID(stub)
+	if err != nil {
+		return err
+	}
+	if *registrator != "" && *registrator != caller {
+		return errors.New("Registrator " + *registrator + " is not the caller " + caller)
+	}
+	if enrollmentID != "" {
+		return errors.New("An enrollment ID can only be bound by an admin with bindEnrollment")
+	}
+	*registrator = caller
+	return nil
+}
+
+// checkSubjectAccess rejects callers who are neither the person or company
+// itself, its registrator nor an admin, and returns the caller's enrollment ID
+func checkSubjectAccess(stub *shim.ChaincodeStub, subjectType string, subjectID string) (string, error) {
+	caller, err := callerID(stub)
+	if err != nil {
+		return "", err
+	}
+	if isAdmin(stub) {
+		return caller, nil
+	}
+
+	var enrollmentID, registrator string
+	if subjectType == ownerTypePerson {
+		person, err := GetPerson(subjectID, stub)
+		if err != nil {
+			return "", err
+		}
+		enrollmentID, registrator = person.EnrollmentID, person.Registrator
+	} else if subjectType == ownerTypeCompany {
+		company, err := GetCompany(subjectID, stub)
+		if err != nil {
+			return "", err
+		}
+		enrollmentID, registrator = company.EnrollmentID, company.Registrator
+	} else {
+		return "", errors.New("Unknown subject type " + subjectType + ", expecting person or company")
+	}
+
+	if !isSubjectOrRegistrator(caller, enrollmentID, registrator) {
+		return "", errors.New(caller + " is not allowed to act for " + subjectType + " " + subjectID)
+	}
+	return caller, nil
+}
+
+func (t *SimpleChaincode) bindEnrollment(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	/*		0				1			2
+			"person"		"id"		"enrollmentId"
+	*/
+	if len(args) != 3 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting subject type, ID and enrollment ID")
+	}
+	_, err := checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if args[0] == ownerTypePerson {
+		person, err := GetPerson(args[1], stub)
+		if err != nil {
+			return nil, errors.New("Person " + args[1] + " not found")
+		}
+		if person.Status == statusErased {
+			return nil, errors.New("Person " + args[1] + " has been erased")
+		}
+		person.EnrollmentID = args[2]
+		err = putRecord(stub, personPrefix+person.ID, &person)
+		if err != nil {
+			return nil, err
+		}
+	} else if args[0] == ownerTypeCompany {
+		company, err := GetCompany(args[1], stub)
+		if err != nil {
+			return nil, errors.New("Company " + args[1] + " not found")
+		}
+		company.EnrollmentID = args[2]
+		err = putRecord(stub, companyPrefix+company.ID, &company)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, errors.New("Unknown subject type " + args[0] + ", expecting person or company")
+	}
+
+	fmt.Println("Bound enrollment " + args[2] + " to " + args[0] + " " + args[1])
+	return nil, nil
+}
+
+// filterCompany returns the part of a company the caller may see. The company
+// itself and its registrator see the whole record; everyone else sees the
+// register details without the registrator and the status history, whose
+// reasons and actors are for the registry's own use.
+func filterCompany(stub *shim.ChaincodeStub, company Company) Company {
+	caller, err := callerID(stub)
+	if err == nil && isSubjectOrRegistrator(caller, company.EnrollmentID, company.Registrator) {
+		return company
+	}
+	company.EnrollmentID = ""
+	company.Registrator = ""
+	company.StatusHistory = nil
+	return company
+}
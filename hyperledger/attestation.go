@@ -0,0 +1,370 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: signed verification attestations
+
+A successful verifyPerson/verifyCompany invoke issues an attestation: a
+statement that subject X matched fields Y at time T, bound to a hash of the
+registry record at that time. It is signed with an ed25519 attestation key.
+Ed25519 signatures are deterministic, so every peer produces the same
+attestation.
+
+The private key never reaches the ledger: each peer reads the signing seed
+from IDMAN_ATTEST_SEED, see secrets.go. An admin registers the matching public
+key with setAttestationKey, which makes it the current key. Peers only sign
+with the current key, and relying parties check signatures against the
+registered public keys.
+*/
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var attestationPrefix = "attest:"
+var attestCurrentKey = "AttestCurrentKey"
+var attestPublicKeyPrefix = "AttestPubKey:"
+
+// Where older versions kept the signing seed, removed by Init
+var legacyAttestSigningKey = "AttestSigningKey"
+
+// AttestationStatement is the signed part of an Attestation. The signature is
+// over the json encoding of this struct, fields in the order declared here.
+type AttestationStatement struct {
+	SubjectType    string   `json:"subjectType"`
+	SubjectID      string   `json:"subjectId"`
+	MatchedFields  []string `json:"matchedFields"`
+	IssuedAt       string   `json:"issuedAt"`
+	RecordVersion  string   `json:"recordVersion"`
+	VerificationID string   `json:"verificationId"`
+	KeyID          string   `json:"keyId"`
+}
+
+// Attestation is a signed AttestationStatement. ID is the hex sha256 of the
+// signed bytes.
+type Attestation struct {
+	ID        string               `json:"id"`
+	Statement AttestationStatement `json:"statement"`
+	Signature string               `json:"signature"`
+}
+
+// AttestationCheck is the result of CheckAttestation
+type AttestationCheck struct {
+	AttestationID  string `json:"attestationId"`
+	Valid          bool   `json:"valid"`
+	SignatureValid bool   `json:"signatureValid"`
+	OnLedger       bool   `json:"onLedger"`
+	RecordCurrent  bool   `json:"recordCurrent"`
+	SubjectStatus  string `json:"subjectStatus"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+// isPrivateKey reports whether a state key must never be returned by a query
+func isPrivateKey(key string) bool {
+	return key == legacyAttestSigningKey
+}
+
+// attestationKeyID is the ID of an attestation public key
+func attestationKeyID(public ed25519.PublicKey) string {
+	sum := sha256.Sum256(public)
+	return hex.EncodeToString(sum[:8])
+}
+
+// recordVersion is the hex sha256 of the registry record of a subject as it
+// is currently stored, or as it was stored before an erased person was erased
+func recordVersion(stub *shim.ChaincodeStub, subjectType string, subjectID string) (string, error) {
+	prefix := personPrefix
+	if subjectType == ownerTypeCompany {
+		prefix = companyPrefix
+	}
+
+	recordBytes, err := stub.GetState(prefix + subjectID)
+	if err != nil || recordBytes == nil {
+		return "", errors.New("No " + subjectType + " record found for " + subjectID)
+	}
+	if subjectType == ownerTypePerson {
+		var person Person
+		if json.Unmarshal(recordBytes, &person) == nil && person.ErasedRecordHash != "" {
+			return person.ErasedRecordHash, nil
+		}
+	}
+	sum := sha256.Sum256(recordBytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (t *SimpleChaincode) setAttestationKey(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	/*		0
+			base64 encoded 32 byte ed25519 public key
+	*/
+	if len(args) != 1 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting attestation public key")
+	}
+	_, err := checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := base64.StdEncoding.DecodeString(args[0])
+	if err != nil || len(public) != ed25519.PublicKeySize {
+		return nil, errors.New("Attestation public key must be 32 bytes, base64 encoded")
+	}
+	keyID := attestationKeyID(ed25519.PublicKey(public))
+
+	// Public keys are kept after rotation so older attestations still check
+	err = stub.PutState(attestPublicKeyPrefix+keyID, []byte(args[0]))
+	if err != nil {
+		fmt.Println("Error writing attestation public key")
+		return nil, errors.New("Error setting attestation key")
+	}
+	err = appendKey(stub, attestPublicKeyPrefix+"Keys", keyID)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(attestCurrentKey, []byte(keyID))
+	if err != nil {
+		fmt.Println("Error writing current attestation key")
+		return nil, errors.New("Error setting attestation key")
+	}
+
+	fmt.Println("Attestation key set, key ID " + keyID)
+	return nil, nil
+}
+
+// getAttestationSigner returns the ID and private key of the current
+// attestation key, or a blank ID when no key has been registered or this peer
+// has no seed. A peer whose seed isn't the current key can't sign.
+func getAttestationSigner(stub *shim.ChaincodeStub) (string, ed25519.PrivateKey, error) {
+	currentBytes, err := stub.GetState(attestCurrentKey)
+	if err != nil {
+		fmt.Println("Error retrieving current attestation key")
+		return "", nil, errors.New("Error retrieving attestation key")
+	}
+	if currentBytes == nil || attestSeed == "" {
+		return "", nil, nil
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(attestSeed)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return "", nil, errors.New(attestSeedEnv + " must be a 32 byte seed, base64 encoded")
+	}
+	private := ed25519.NewKeyFromSeed(seed)
+	keyID := attestationKeyID(private.Public().(ed25519.PublicKey))
+	if keyID != string(currentBytes) {
+		return "", nil, errors.New("This peer's attestation key " + keyID + " is not the current key " + string(currentBytes))
+	}
+	return keyID, private, nil
+}
+
+// removeLegacyAttestationSeed deletes the signing seed older versions kept in
+// world state. Its public key stays registered so that attestations it signed
+// still check, but nothing is signed with it any more. It is run from Init.
+func removeLegacyAttestationSeed(stub *shim.ChaincodeStub) error {
+	seedBytes, err := stub.GetState(legacyAttestSigningKey)
+	if err != nil || seedBytes == nil {
+		return err
+	}
+	err = stub.DelState(legacyAttestSigningKey)
+	if err != nil {
+		fmt.Println("Error deleting legacy attestation seed")
+		return errors.New("Error deleting legacy attestation seed")
+	}
+	return nil
+}
+
+// GetAttestationKeys returns every attestation public key by key ID, base64
+// encoded, so relying parties can check signatures offline
+func GetAttestationKeys(stub *shim.ChaincodeStub) (map[string]string, error) {
+	keys := map[string]string{}
+
+	keyIDs, err := getKeyList(stub, attestPublicKeyPrefix+"Keys")
+	if err != nil {
+		return nil, err
+	}
+	for _, keyID := range keyIDs {
+		public, err := stub.GetState(attestPublicKeyPrefix + keyID)
+		if err != nil {
+			fmt.Println("Error retrieving attestation public key " + keyID)
+			return nil, errors.New("Error retrieving attestation public key " + keyID)
+		}
+		keys[keyID] = string(public)
+	}
+	return keys, nil
+}
+
+// issueAttestation signs and stores an attestation for a passed verification.
+// It returns an empty ID when no attestation key has been set.
+func issueAttestation(stub *shim.ChaincodeStub, record VerificationRecord) (string, error) {
+
+	keyID, private, err := getAttestationSigner(stub)
+	if err != nil {
+		return "", err
+	}
+	if keyID == "" {
+		fmt.Println("No attestation key set, not issuing an attestation")
+		return "", nil
+	}
+
+	version, err := recordVersion(stub, record.SubjectType, record.SubjectID)
+	if err != nil {
+		return "", err
+	}
+
+	statement := AttestationStatement{
+		SubjectType:    record.SubjectType,
+		SubjectID:      record.SubjectID,
+		MatchedFields:  []string{},
+		IssuedAt:       record.Timestamp,
+		RecordVersion:  version,
+		VerificationID: record.ID,
+		KeyID:          keyID,
+	}
+	for _, f := range record.Fields {
+		if f.Outcome == outcomeMatched {
+			statement.MatchedFields = append(statement.MatchedFields, f.Field)
+		}
+	}
+
+	statementBytes, err := json.Marshal(&statement)
+	if err != nil {
+		fmt.Println("Error marshalling attestation statement")
+		return "", errors.New("Error issuing attestation")
+	}
+	sum := sha256.Sum256(statementBytes)
+	attestation := Attestation{
+		ID:        hex.EncodeToString(sum[:]),
+		Statement: statement,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(private, statementBytes)),
+	}
+
+	attestationBytes, err := json.Marshal(&attestation)
+	if err != nil {
+		fmt.Println("Error marshalling attestation")
+		return "", errors.New("Error issuing attestation")
+	}
+	err = stub.PutState(attestationPrefix+attestation.ID, attestationBytes)
+	if err != nil {
+		fmt.Println("Error writing attestation")
+		return "", errors.New("Error issuing attestation")
+	}
+
+	fmt.Println("Issued attestation " + attestation.ID)
+	return attestation.ID, nil
+}
+
+// GetAttestation returns a stored attestation by ID
+func GetAttestation(stub *shim.ChaincodeStub, attestationID string) (Attestation, error) {
+	var attestation Attestation
+
+	attestationBytes, err := stub.GetState(attestationPrefix + attestationID)
+	if err != nil || attestationBytes == nil {
+		return attestation, errors.New("Attestation " + attestationID + " not found")
+	}
+	err = json.Unmarshal(attestationBytes, &attestation)
+	if err != nil {
+		fmt.Println("Error unmarshalling attestation " + attestationID)
+		return attestation, errors.New("Error unmarshalling attestation " + attestationID)
+	}
+	return attestation, nil
+}
+
+// CheckAttestation checks an attestation presented by a relying party: that
+// its signature is good, that the chaincode issued it, and whether the record
+// it is bound to is unchanged and still active
+func CheckAttestation(stub *shim.ChaincodeStub, sAttestation string) (AttestationCheck, error) {
+	var check AttestationCheck
+	var attestation Attestation
+
+	err := json.Unmarshal([]byte(sAttestation), &attestation)
+	if err != nil {
+		return check, errors.New("Error unmarshalling attestation")
+	}
+
+	statementBytes, err := json.Marshal(&attestation.Statement)
+	if err != nil {
+		return check, errors.New("Error marshalling attestation statement")
+	}
+	sum := sha256.Sum256(statementBytes)
+	check.AttestationID = hex.EncodeToString(sum[:])
+
+	// Signature
+	public, err := stub.GetState(attestPublicKeyPrefix + attestation.Statement.KeyID)
+	if err != nil || public == nil {
+		check.Reason = "unknown attestation key " + attestation.Statement.KeyID
+		return check, nil
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(string(public))
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return check, errors.New("Stored attestation public key is invalid")
+	}
+	signature, err := base64.StdEncoding.DecodeString(attestation.Signature)
+	check.SignatureValid = err == nil && ed25519.Verify(ed25519.PublicKey(publicKey), statementBytes, signature)
+	if !check.SignatureValid {
+		check.Reason = "signature does not match statement"
+		return check, nil
+	}
+
+	// Issued by this chaincode
+	stored, err := GetAttestation(stub, check.AttestationID)
+	check.OnLedger = err == nil && stored.Signature == attestation.Signature
+	if !check.OnLedger {
+		check.Reason = "attestation was not issued by this registry"
+		return check, nil
+	}
+
+	// Still bound to the current record. The stored copy names the subject
+	// under its current ID, which erasure changes.
+	version, err := recordVersion(stub, stored.Statement.SubjectType, stored.Statement.SubjectID)
+	check.RecordCurrent = err == nil && version == attestation.Statement.RecordVersion
+	check.SubjectStatus = subjectStatus(stub, stored.Statement.SubjectType, stored.Statement.SubjectID)
+	if !check.RecordCurrent {
+		check.Reason = "record has changed since the attestation was issued"
+		return check, nil
+	}
+	if check.SubjectStatus != statusActive {
+		check.Reason = "subject is " + check.SubjectStatus
+		return check, nil
+	}
+
+	check.Valid = true
+	return check, nil
+}
+
+// subjectStatus returns the current status of a person or company, or blank
+// when there is no record
+func subjectStatus(stub *shim.ChaincodeStub, subjectType string, subjectID string) string {
+	if subjectType == ownerTypeCompany {
+		company, err := GetCompany(subjectID, stub)
+		if err != nil {
+			return ""
+		}
+		return effectiveStatus(company.Status)
+	}
+	person, err := GetPerson(subjectID, stub)
+	if err != nil {
+		return ""
+	}
+	return effectiveStatus(person.Status)
+}
@@ -0,0 +1,236 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: bulk registration of persons and companies
+
+registerPersonsBatch and registerCompaniesBatch take a json array of records
+and register each one as registerPerson and registerCompany would. An entry
+whose ID or unique identifiers are already registered, earlier in the batch
+included, is a duplicate, and its result names the registered record if the
+caller may act for it; an entry that fails its checks is invalid. Each
+entry is checked before anything of it is written, so duplicate and invalid
+entries leave nothing on the ledger. By default the valid entries are
+registered, the others skipped, and the per-item results returned. In strict
+mode the first duplicate or invalid entry fails the whole transaction, so the
+peer discards everything the batch wrote, and the results so far are returned
+in the error. An error while writing a checked entry fails the transaction in
+either mode.
+
+Photos are put in the photo store by the client before the batch, and the
+store isn't part of the transaction: the photos of invalid entries and of
+rejected strict batches are left unreferenced, for GetUnreferencedPhotos to
+find.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Outcome of one batch entry
+const (
+	batchCreated   = "created"
+	batchDuplicate = "duplicate"
+	batchInvalid   = "invalid"
+)
+
+var batchStrict = "strict"
+
+var maxBatchSize = 1000
+
+// BatchResult is the outcome of one entry of a batch registration
+type BatchResult struct {
+	Index      int    `json:"index"`
+	ID         string `json:"id,omitempty"`
+	Outcome    string `json:"outcome"`
+	ExistingID string `json:"existingId,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// batchArgs reads the entries and the mode of a batch registration
+func batchArgs(args []string) ([]json.RawMessage, bool, error) {
+
+	/*		0						1
+			json array of records	optional "strict"
+	*/
+	var entries []json.RawMessage
+
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Println("error invalid arguments")
+		return nil, false, errors.New("Incorrect number of arguments. Expecting json array of records and optionally strict")
+	}
+	strict := optionalArg(args, 1) == batchStrict
+	if optionalArg(args, 1) != "" && !strict {
+		return nil, false, errors.New("Unknown batch mode " + args[1] + ", expecting strict")
+	}
+
+	err := json.Unmarshal([]byte(args[0]), &entries)
+	if err != nil {
+		return nil, false, errors.New("Expecting a json array of records")
+	}
+	if len(entries) == 0 || len(entries) > maxBatchSize {
+		return nil, false, errors.New("A batch must hold between 1 and " + strconv.Itoa(maxBatchSize) + " records")
+	}
+	return entries, strict, nil
+}
+
+// findDuplicate tells whether an entry clashes with a registered record, and
+// returns the ID of that record if the caller may act for it. Identifiers are
+// checked in the same order as checkUniqueIndexes does.
+func findDuplicate(stub *shim.ChaincodeStub, subjectType string, subjectID string, values map[string]string) (string, bool, error) {
+	key := personPrefix + subjectID
+	if subjectType == ownerTypeCompany {
+		key = companyPrefix + subjectID
+	}
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return "", false, errors.New("Error retrieving " + key)
+	}
+	if existing != nil {
+		return subjectID, true, nil
+	}
+
+	_, holder, err := indexHolder(stub, subjectType, subjectID, values)
+	if err != nil || holder == "" {
+		return "", false, err
+	}
+	// Whose email or licence it is isn't for every registrator to learn
+	if _, err = checkSubjectAccess(stub, subjectType, holder); err != nil {
+		return "", true, nil
+	}
+	return holder, true, nil
+}
+
+// finishBatch returns the results, failing the transaction in strict mode
+// when an entry wasn't created
+func finishBatch(results []BatchResult, strict bool) ([]byte, error) {
+	resultsBytes, err := json.Marshal(&results)
+	if err != nil {
+		fmt.Println("Error marshalling batch results")
+		return nil, errors.New("Error marshalling batch results")
+	}
+
+	created := 0
+	for _, result := range results {
+		if result.Outcome == batchCreated {
+			created++
+		}
+	}
+	fmt.Println("Batch registered " + strconv.Itoa(created) + " of " + strconv.Itoa(len(results)) + " records")
+	if strict && created != len(results) {
+		return nil, errors.New("Strict batch rejected, nothing registered: " + string(resultsBytes))
+	}
+	return resultsBytes, nil
+}
+
+func (t *SimpleChaincode) registerPersonsBatch(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	entries, strict, err := batchArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []BatchResult
+	for i, entry := range entries {
+		result := BatchResult{Index: i}
+
+		var person Person
+		var duplicate bool
+		err = json.Unmarshal(entry, &person)
+		if err == nil {
+			result.ID = personID(person)
+			result.ExistingID, duplicate, err = findDuplicate(stub, ownerTypePerson, result.ID, personIndexValues(person))
+		}
+		if err == nil && !duplicate {
+			var checked Person
+			checked, err = checkNewPerson(stub, string(entry))
+			if err == nil {
+				// The entry is valid, a failure now fails the whole batch
+				err = putNewPerson(stub, checked)
+				if err != nil {
+					return nil, errors.New("Error registering batch entry " + strconv.Itoa(i) + ": " + err.Error())
+				}
+			}
+		}
+
+		if err != nil {
+			result.Outcome = batchInvalid
+			result.Error = err.Error()
+		} else if duplicate {
+			result.Outcome = batchDuplicate
+		} else {
+			result.Outcome = batchCreated
+		}
+		results = append(results, result)
+
+		// Strict batches fail as a whole, so there is no point going on
+		if strict && result.Outcome != batchCreated {
+			break
+		}
+	}
+	return finishBatch(results, strict)
+}
+
+func (t *SimpleChaincode) registerCompaniesBatch(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	entries, strict, err := batchArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []BatchResult
+	for i, entry := range entries {
+		result := BatchResult{Index: i}
+
+		var company Company
+		var duplicate bool
+		err = json.Unmarshal(entry, &company)
+		if err == nil {
+			result.ID = companyID(company)
+			result.ExistingID, duplicate, err = findDuplicate(stub, ownerTypeCompany, result.ID, companyIndexValues(company))
+		}
+		if err == nil && !duplicate {
+			var checked Company
+			checked, err = checkNewCompany(stub, string(entry))
+			if err == nil {
+				// The entry is valid, a failure now fails the whole batch
+				err = putNewCompany(stub, checked)
+				if err != nil {
+					return nil, errors.New("Error registering batch entry " + strconv.Itoa(i) + ": " + err.Error())
+				}
+			}
+		}
+
+		if err != nil {
+			result.Outcome = batchInvalid
+			result.Error = err.Error()
+		} else if duplicate {
+			result.Outcome = batchDuplicate
+		} else {
+			result.Outcome = batchCreated
+		}
+		results = append(results, result)
+
+		// Strict batches fail as a whole, so there is no point going on
+		if strict && result.Outcome != batchCreated {
+			break
+		}
+	}
+	return finishBatch(results, strict)
+}
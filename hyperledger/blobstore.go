@@ -0,0 +1,163 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: content-addressed store for data kept off the ledger
+
+Blobs are addressed by "sha256:<hex>" of their content, so every peer that
+stores the same blob gets the same digest and writing it twice is harmless.
+FileBlobStore keeps blobs in a local directory and is meant for local testing;
+any other store can be plugged in by setting photoStore. Clients write to the
+store and the chaincode only reads it, to check that a reference points to a
+stored blob. Every peer must be configured with the same store, or the peers
+that can't find a blob reject the transactions referring to it.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var digestPrefix = "sha256:"
+
+// Environment variable naming the directory of the filesystem blob store
+var blobDirEnv = "IDMAN_BLOB_DIR"
+
+// BlobStore stores blobs by the digest of their content
+type BlobStore interface {
+	Put(data []byte) (string, error)
+	Get(digest string) ([]byte, error)
+	Delete(digest string) error
+	List() ([]string, error)
+}
+
+// blobDigest returns the content address of a blob
+func blobDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return digestPrefix + hex.EncodeToString(sum[:])
+}
+
+// isBlobDigest reports whether s is a well formed content address
+func isBlobDigest(s string) bool {
+	if !strings.HasPrefix(s, digestPrefix) {
+		return false
+	}
+	sum, err := hex.DecodeString(strings.TrimPrefix(s, digestPrefix))
+	return err == nil && len(sum) == sha256.Size
+}
+
+// FileBlobStore keeps each blob in a file named by its digest under Dir
+type FileBlobStore struct {
+	Dir string
+}
+
+func (s FileBlobStore) path(digest string) (string, error) {
+	if !isBlobDigest(digest) {
+		return "", errors.New("Invalid blob digest " + digest)
+	}
+	return filepath.Join(s.Dir, "sha256", strings.TrimPrefix(digest, digestPrefix)), nil
+}
+
+// Put writes a blob unless it is already stored and returns its digest
+func (s FileBlobStore) Put(data []byte) (string, error) {
+	digest := blobDigest(data)
+	path, err := s.path(digest)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return digest, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return "", errors.New("Error creating blob directory: " + err.Error())
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", errors.New("Error writing blob " + digest + ": " + err.Error())
+	}
+	return digest, nil
+}
+
+// Get reads a blob and checks that its content still matches the digest
+func (s FileBlobStore) Get(digest string) ([]byte, error) {
+	path, err := s.path(digest)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("Blob " + digest + " not found")
+	}
+	if blobDigest(data) != digest {
+		return nil, errors.New("Blob " + digest + " is corrupt")
+	}
+	return data, nil
+}
+
+// Delete removes a blob. Deleting a blob that isn't stored is not an error.
+func (s FileBlobStore) Delete(digest string) error {
+	path, err := s.path(digest)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New("Error deleting blob " + digest + ": " + err.Error())
+	}
+	return nil
+}
+
+// List returns the digests of every stored blob
+func (s FileBlobStore) List() ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.Dir, "sha256"))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, errors.New("Error listing blobs: " + err.Error())
+	}
+
+	digests := []string{}
+	for _, file := range files {
+		digest := digestPrefix + file.Name()
+		if isBlobDigest(digest) {
+			digests = append(digests, digest)
+		}
+	}
+	return digests, nil
+}
+
+// blobStoreFromEnv returns the filesystem store named by IDMAN_BLOB_DIR, or
+// nil when it isn't set
+func blobStoreFromEnv() BlobStore {
+	dir := os.Getenv(blobDirEnv)
+	if dir == "" {
+		return nil
+	}
+	return FileBlobStore{Dir: dir}
+}
@@ -0,0 +1,190 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: salted claim hashes for selective disclosure
+
+Every claim of a Person is stored with a salted hash next to it. The salts
+are derived with the peers' hash key, see secrets.go, so they can't be
+computed from the ledger, and are private to the holder: only the person,
+their registrator or an admin can fetch them with GetClaimSalts, and the
+hashes are never returned by the read queries. The holder hands the salts to a verifier, which hashes the claims it
+holds as hex(sha256(salt + ":" + value)) and sends only those hashes to
+VerifyPersonClaims. The answer is match or no-match per claim and nothing
+else. Values are trimmed before hashing, emails are lower-cased and birth
+dates are put in the canonical form of a Timestamp.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Outcome of comparing one hashed claim
+const (
+	claimMatch   = "match"
+	claimNoMatch = "no-match"
+	claimUnknown = "unknown"
+)
+
+// ClaimHash is the salted hash of one claim
+type ClaimHash struct {
+	Salt string `json:"salt"`
+	Hash string `json:"hash"`
+}
+
+// ClaimsCheck is the result of VerifyPersonClaims
+type ClaimsCheck struct {
+	PersonID string            `json:"personId"`
+	Results  map[string]string `json:"results"`
+}
+
+func normaliseClaim(field string, value string) string {
+	value = strings.TrimSpace(value)
+	if field == "email" {
+		value = strings.ToLower(value)
+	}
+	if field == "birthDate" {
+		canonical, _ := canonicalTimestamp(value)
+		value = string(canonical)
+	}
+	return value
+}
+
+func hashClaim(salt string, field string, value string) string {
+	sum := sha256.Sum256([]byte(salt + ":" + normaliseClaim(field, value)))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashPersonClaims fills in the salted hash of every claim of a person. Salts
+// are keyed hashes of the transaction ID, so that every peer computes the
+// same but nobody without the peers' hash key can.
+func hashPersonClaims(stub *shim.ChaincodeStub, person *Person) error {
+	person.ClaimHashes = map[string]ClaimHash{}
+	for field, value := range personVerifyFields {
+		if value(*person) == "" {
+			continue
+		}
+		salt, err := keyedHash("claim-salt", stub.UUID+":"+person.ID+":"+field)
+		if err != nil {
+			return err
+		}
+		salt = salt[:32]
+		person.ClaimHashes[field] = ClaimHash{Salt: salt, Hash: hashClaim(salt, field, value(*person))}
+	}
+	return nil
+}
+
+// hashLegacyClaims adds claim hashes to persons registered before claims were
+// hashed. It is run from Init. The records are read as stored, so a merged
+// duplicate is left as it is rather than overwritten by its survivor.
+func hashLegacyClaims(stub *shim.ChaincodeStub) error {
+	keys, err := getKeyList(stub, personKeysID)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		var person Person
+		persBytes, err := stub.GetState(key)
+		if err != nil || persBytes == nil {
+			continue
+		}
+		err = json.Unmarshal(persBytes, &person)
+		if err != nil || person.MergedInto != "" || person.ClaimHashes != nil {
+			continue
+		}
+		err = hashPersonClaims(stub, &person)
+		if err != nil {
+			return err
+		}
+
+		persBytes, err = json.Marshal(&person)
+		if err != nil {
+			fmt.Println("Error marshalling person " + person.ID)
+			return errors.New("Error hashing claims of person " + person.ID)
+		}
+		err = stub.PutState(key, persBytes)
+		if err != nil {
+			fmt.Println("Error writing person " + person.ID)
+			return errors.New("Error hashing claims of person " + person.ID)
+		}
+	}
+	return nil
+}
+
+// GetClaimSalts returns the salt of each hashed claim of a person
+func GetClaimSalts(stub *shim.ChaincodeStub, personID string) (map[string]string, error) {
+	person, err := GetPerson(personID, stub)
+	if err != nil {
+		return nil, err
+	}
+	_, err = checkSubjectAccess(stub, ownerTypePerson, person.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	salts := map[string]string{}
+	for field, claim := range person.ClaimHashes {
+		salts[field] = claim.Salt
+	}
+	return salts, nil
+}
+
+// VerifyPersonClaims compares hashed claims with the stored claim hashes of an
+// active person. Claims the registry holds no hash for are unknown.
+func VerifyPersonClaims(stub *shim.ChaincodeStub, personID string, sHashes string) (ClaimsCheck, error) {
+	var check ClaimsCheck
+	var hashes map[string]string
+
+	err := json.Unmarshal([]byte(sHashes), &hashes)
+	if err != nil {
+		return check, errors.New("Expecting a json object of claim name to claim hash")
+	}
+	if len(hashes) == 0 {
+		return check, errors.New("No claim hashes to verify")
+	}
+
+	person, err := GetPerson(personID, stub)
+	if err != nil {
+		return check, errors.New("Person " + personID + " not found")
+	}
+	if effectiveStatus(person.Status) != statusActive {
+		return check, errors.New("Person " + personID + " is " + person.Status + ", only active persons can be verified")
+	}
+
+	check.PersonID = person.ID
+	check.Results = map[string]string{}
+	for field, hash := range hashes {
+		if _, ok := personVerifyFields[field]; !ok {
+			return check, errors.New("Unknown claim " + field)
+		}
+		stored, ok := person.ClaimHashes[field]
+		if !ok {
+			check.Results[field] = claimUnknown
+		} else if strings.ToLower(hash) == stored.Hash {
+			check.Results[field] = claimMatch
+		} else {
+			check.Results[field] = claimNoMatch
+		}
+	}
+	return check, nil
+}
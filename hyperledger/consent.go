@@ -0,0 +1,393 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: consent registry governing who may read a person's data
+
+A person, or the registrator of the person, grants a named relying party
+access to a set of fields until an expiry date. The relying party is the
+enrollment ID of the caller, so a caller can only use its own consents.
+Queries returning persons show a relying party only the fields it has active
+consent for, plus the non-personal fields every caller sees. The ID of a
+person is derived from their names, so it is shown only with consent to both
+names. The queries that answer about a field without returning it, such as
+IsPersonOlderThan and CheckPersonPhoto, need consent to that field too. The
+person and their registrator see the whole record. Every grant and revoke is
+logged with the enrollment ID of the caller who made it. A consent can be read
+by its relying party, and consents and the log by the person, their
+registrator or an admin.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var consentPrefix = "consent:"
+var consentLogPrefix = "consentlog:"
+var consentLogKeysPrefix = "ConsentLogKeys:"
+
+// Consent lets a relying party read some fields of a person until Expiry
+type Consent struct {
+	PersonID     string   `json:"personId"`
+	RelyingParty string   `json:"relyingParty"`
+	Fields       []string `json:"fields"`
+	Expiry       string   `json:"expiry"`
+	GrantedBy    string   `json:"grantedBy"`
+	GrantedAt    string   `json:"grantedAt"`
+	RevokedBy    string   `json:"revokedBy,omitempty"`
+	RevokedAt    string   `json:"revokedAt,omitempty"`
+}
+
+// ConsentEvent is one entry of the consent log of a person
+type ConsentEvent struct {
+	Action       string   `json:"action"`
+	PersonID     string   `json:"personId"`
+	RelyingParty string   `json:"relyingParty"`
+	Fields       []string `json:"fields,omitempty"`
+	Expiry       string   `json:"expiry,omitempty"`
+	Actor        string   `json:"actor"`
+	Date         string   `json:"date"`
+}
+
+// Person fields that need consent, by json name. Status and register date are
+// visible to every caller.
+var consentFields = map[string]func(dst *Person, src Person){
+	"firstName":      func(d *Person, s Person) { d.FirstName = s.FirstName },
+	"lastName":       func(d *Person, s Person) { d.LastName = s.LastName },
+	"email":          func(d *Person, s Person) { d.Email = s.Email },
+	"birthDate":      func(d *Person, s Person) { d.BirthDate = s.BirthDate },
+	"gender":         func(d *Person, s Person) { d.Gender = s.Gender },
+	"drivingLicence": func(d *Person, s Person) { d.DrivingLicence = s.DrivingLicence },
+	"tfn":            func(d *Person, s Person) { d.TFN = s.TFN },
+	"address":        func(d *Person, s Person) { d.Address = s.Address },
+	"city":           func(d *Person, s Person) { d.City = s.City },
+	"postcode":       func(d *Person, s Person) { d.Postcode = s.Postcode },
+	"state":          func(d *Person, s Person) { d.State = s.State },
+	"urlLinks":       func(d *Person, s Person) { d.UrlLinks = s.UrlLinks },
+	"dataPhoto":      func(d *Person, s Person) { d.DataPhoto, d.Photo = s.DataPhoto, s.Photo },
+}
+
+func consentKey(personID string, relyingParty string) string {
+	return consentPrefix + personID + ":" + relyingParty
+}
+
+// GetConsent returns the consent a relying party holds for a person, which may
+// have expired or been revoked
+func GetConsent(stub *shim.ChaincodeStub, personID string, relyingParty string) (Consent, bool, error) {
+	var consent Consent
+
+	consentBytes, err := stub.GetState(consentKey(personID, relyingParty))
+	if err != nil {
+		fmt.Println("Error retrieving consent of " + personID + " for " + relyingParty)
+		return consent, false, errors.New("Error retrieving consent of " + personID + " for " + relyingParty)
+	}
+	if consentBytes == nil {
+		return consent, false, nil
+	}
+	err = json.Unmarshal(consentBytes, &consent)
+	if err != nil {
+		fmt.Println("Error unmarshalling consent of " + personID + " for " + relyingParty)
+		return consent, false, errors.New("Error unmarshalling consent of " + personID + " for " + relyingParty)
+	}
+	return consent, true, nil
+}
+
+func (c Consent) activeAt(now time.Time) bool {
+	if c.RevokedAt != "" {
+		return false
+	}
+	expiry, err := parseDate(c.Expiry)
+	return err == nil && now.Before(expiry)
+}
+
+// checkConsentReader allows only the relying party, the person, their
+// registrator or an admin to read a consent of a person
+func checkConsentReader(stub *shim.ChaincodeStub, personID string, relyingParty string) error {
+	caller, err := callerID(stub)
+	if err != nil {
+		return err
+	}
+	if caller == relyingParty {
+		return nil
+	}
+	_, err = checkSubjectAccess(stub, ownerTypePerson, personID)
+	return err
+}
+
+// checkConsentActor allows only the person or their registrator to change
+// the consents of a person, and returns the caller
+func checkConsentActor(stub *shim.ChaincodeStub, person Person) (string, error) {
+	actor, err := callerID(stub)
+	if err != nil {
+		return "", err
+	}
+	if !isSubjectOrRegistrator(actor, person.EnrollmentID, person.Registrator) {
+		return "", errors.New("Only person " + person.ID + " or their registrator can change their consents")
+	}
+	return actor, nil
+}
+
+func logConsentEvent(stub *shim.ChaincodeStub, event ConsentEvent) error {
+	listKey := consentLogKeysPrefix + event.PersonID
+	keys, err := getKeyList(stub, listKey)
+	if err != nil {
+		return err
+	}
+
+	key := consentLogPrefix + event.PersonID + ":" + strconv.Itoa(len(keys))
+	eventBytes, err := json.Marshal(&event)
+	if err != nil {
+		fmt.Println("Error marshalling consent event")
+		return errors.New("Error logging consent event")
+	}
+	err = stub.PutState(key, eventBytes)
+	if err != nil {
+		fmt.Println("Error writing consent event")
+		return errors.New("Error logging consent event")
+	}
+	return putKeyList(stub, listKey, append(keys, key))
+}
+
+func putConsent(stub *shim.ChaincodeStub, consent Consent) error {
+	consentBytes, err := json.Marshal(&consent)
+	if err != nil {
+		fmt.Println("Error marshalling consent")
+		return errors.New("Error marshalling consent")
+	}
+	err = stub.PutState(consentKey(consent.PersonID, consent.RelyingParty), consentBytes)
+	if err != nil {
+		fmt.Println("Error writing consent")
+		return errors.New("Error writing consent")
+	}
+	return nil
+}
+
+func (t *SimpleChaincode) grantConsent(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	/*		0
+			json
+			{
+				"personId": "johnsmith",
+				"relyingParty": "acmebank",
+				"fields": ["firstName", "lastName", "email"],
+				"expiry": "2017-06-30"
+			}
+	*/
+	if len(args) != 1 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting consent record")
+	}
+
+	var consent Consent
+	err := json.Unmarshal([]byte(args[0]), &consent)
+	if err != nil {
+		fmt.Println("error invalid consent")
+		return nil, errors.New("Invalid consent")
+	}
+
+	person, err := GetPerson(consent.PersonID, stub)
+	if err != nil {
+		return nil, errors.New("Person " + consent.PersonID + " not found")
+	}
+	consent.GrantedBy, err = checkConsentActor(stub, person)
+	if err != nil {
+		return nil, err
+	}
+	if consent.RelyingParty == "" {
+		return nil, errors.New("Relying party cannot be blank")
+	}
+	if len(consent.Fields) == 0 {
+		return nil, errors.New("Consent must name at least one field")
+	}
+	for _, field := range consent.Fields {
+		if _, ok := consentFields[field]; !ok {
+			return nil, errors.New("Unknown field " + field)
+		}
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	expiry, err := parseDate(consent.Expiry)
+	if err != nil {
+		return nil, err
+	}
+	if !expiry.After(now) {
+		return nil, errors.New("Consent expiry must be in the future")
+	}
+
+	consent.PersonID = person.ID
+	consent.GrantedAt = now.Format(time.RFC3339)
+	consent.RevokedBy = ""
+	consent.RevokedAt = ""
+	err = putConsent(stub, consent)
+	if err != nil {
+		return nil, err
+	}
+
+	err = logConsentEvent(stub, ConsentEvent{Action: "grant", PersonID: person.ID, RelyingParty: consent.RelyingParty,
+		Fields: consent.Fields, Expiry: consent.Expiry, Actor: consent.GrantedBy, Date: consent.GrantedAt})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Consent of " + person.ID + " granted to " + consent.RelyingParty)
+	return nil, nil
+}
+
+func (t *SimpleChaincode) revokeConsent(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	/*		0			1
+			"personId"	"relyingParty"
+	*/
+	if len(args) != 2 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting person ID and relying party")
+	}
+
+	person, err := GetPerson(args[0], stub)
+	if err != nil {
+		return nil, errors.New("Person " + args[0] + " not found")
+	}
+	actor, err := checkConsentActor(stub, person)
+	if err != nil {
+		return nil, err
+	}
+
+	consent, found, err := GetConsent(stub, person.ID, args[1])
+	if err != nil {
+		return nil, err
+	}
+	if !found || consent.RevokedAt != "" {
+		return nil, errors.New("No consent of " + person.ID + " for " + args[1] + " to revoke")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	consent.RevokedBy = actor
+	consent.RevokedAt = now.Format(time.RFC3339)
+	err = putConsent(stub, consent)
+	if err != nil {
+		return nil, err
+	}
+
+	err = logConsentEvent(stub, ConsentEvent{Action: "revoke", PersonID: person.ID, RelyingParty: consent.RelyingParty,
+		Actor: consent.RevokedBy, Date: consent.RevokedAt})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Consent of " + person.ID + " revoked for " + consent.RelyingParty)
+	return nil, nil
+}
+
+// GetConsentLog returns every grant and revoke of the consents of a person,
+// oldest first
+func GetConsentLog(stub *shim.ChaincodeStub, personID string) ([]ConsentEvent, error) {
+	var log []ConsentEvent
+
+	keys, err := getKeyList(stub, consentLogKeysPrefix+personID)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		eventBytes, err := stub.GetState(key)
+		if err != nil {
+			fmt.Println("Error retrieving consent event " + key)
+			return nil, errors.New("Error retrieving consent event " + key)
+		}
+		var event ConsentEvent
+		err = json.Unmarshal(eventBytes, &event)
+		if err != nil {
+			fmt.Println("Error unmarshalling consent event " + key)
+			return nil, errors.New("Error unmarshalling consent event " + key)
+		}
+		log = append(log, event)
+	}
+	return log, nil
+}
+
+// filterPersonByConsent returns the part of a person the caller may see
+func filterPersonByConsent(stub *shim.ChaincodeStub, person Person) (Person, error) {
+	// Claim hashes of low-entropy fields are easily reversed, so never shown
+	person.ClaimHashes = nil
+
+	// Callers without an enrollment ID see only what everyone sees
+	relyingParty, err := callerID(stub)
+	if err == nil && isSubjectOrRegistrator(relyingParty, person.EnrollmentID, person.Registrator) {
+		return person, nil
+	}
+
+	filtered := Person{
+		RegisterDate: person.RegisterDate,
+		Status:       person.Status,
+	}
+	if err != nil {
+		return filtered, nil
+	}
+
+	consent, found, err := GetConsent(stub, person.ID, relyingParty)
+	if err != nil || !found {
+		return filtered, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return filtered, err
+	}
+	if !consent.activeAt(now) {
+		return filtered, nil
+	}
+
+	granted := map[string]bool{}
+	for _, field := range consent.Fields {
+		if copyField, ok := consentFields[field]; ok {
+			copyField(&filtered, person)
+			granted[field] = true
+		}
+	}
+	if granted["firstName"] && granted["lastName"] {
+		filtered.ID = person.ID
+	}
+	return filtered, nil
+}
+
+// visiblePersonID returns the ID of a person if the caller may see it, or
+// blank
+func visiblePersonID(stub *shim.ChaincodeStub, personID string) (string, error) {
+	person, err := GetPerson(personID, stub)
+	if err != nil {
+		return "", err
+	}
+	visible, err := filterPersonByConsent(stub, person)
+	return visible.ID, err
+}
+
+// optionalArg reads an optional query argument, blank when it isn't given
+func optionalArg(args []string, index int) string {
+	if len(args) > index {
+		return args[index]
+	}
+	return ""
+}
@@ -31,6 +31,7 @@ import (
 	"time"
     "strings"
 
+	"github.com/IBM-Blockchain/cp-chaincode-v2/hyperledger/idcheck"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 )
 
@@ -42,6 +43,12 @@ var personPrefix  = "pers:"
 var personKeysID  = "PersKeys"
 var companyPrefix  = "comp:"
 var companyKeysID  = "CompKeys"
+
+// Owner types an Account can be linked to
+const (
+	ownerTypePerson  = "person"
+	ownerTypeCompany = "company"
+)
 /******* ID-Man *********************/
 
 var recentLeapYear = 2016
@@ -50,9 +57,9 @@ var recentLeapYear = 2016
 type SimpleChaincode struct {
 }
 
-func generateCUSIPSuffix(issueDate string, days int) (string, error) {
+func generateCUSIPSuffix(issueDate Timestamp, days int) (string, error) {
 
-	t, err := msToTime(issueDate)
+	t, err := issueDate.Time()
 	if err != nil {
 		return "", err
 	}
@@ -82,6 +89,7 @@ func msToTime(ms string) (time.Time, error) {
 }
 
 /************* ID-Man **************************/
+// UrlLink is a link of a Person or Company; UrlType is one of knownLinkTypes
 type UrlLink struct {
     Url         string   `json:"url"`
     UrlType     string   `json:"urlType"`
@@ -92,7 +100,7 @@ type Person struct {
 	FirstName		string 	`json:"firstName"`
 	LastName		string 	`json:"lastName"`
 	Email			string 	`json:"email"`
-	BirthDate		string 	`json:"birthDate"`
+	BirthDate		Timestamp `json:"birthDate"`
 	Gender			string 	`json:"gender"`
 	DrivingLicence	string 	`json:"drivingLicence"`
 	TFN 			string 	`json:"tfn"`
@@ -102,8 +110,18 @@ type Person struct {
 	State    		string  `json:"state"`
 	UrlLinks      []UrlLink `json:"urlLinks"`
 	DataPhoto		string  `json:"dataPhoto"`
+	Photo 			*PhotoRef `json:"photo,omitempty"`
 	Registrator    	string  `json:"registrator"`
-	RegisterDate 	string  `json:"registerDate"`
+	EnrollmentID 	string  `json:"enrollmentId,omitempty"`
+	RegisterDate 	Timestamp `json:"registerDate"`
+	EffectiveDate 	Timestamp `json:"effectiveDate,omitempty"`
+	Status 			string  `json:"status"`
+	StatusHistory []StatusChange `json:"statusHistory"`
+	ClaimHashes map[string]ClaimHash `json:"claimHashes"`
+	ErasedRecordHash string `json:"erasedRecordHash,omitempty"`
+	MergedInto 		string  `json:"mergedInto,omitempty"`
+	MergedFrom 		[]string `json:"mergedFrom,omitempty"`
+	RedirectedFrom 	string  `json:"redirectedFrom,omitempty"`
 }
 
 type Company struct {
@@ -111,7 +129,7 @@ type Company struct {
 	Name			string 	`json:"name"`
 	ACN 			string 	`json:"acn"`
 	ABN 			string 	`json:"abn"`
-	RegDate 		string 	`json:"regDate"`
+	RegDate 		Timestamp `json:"regDate"`
 	RegState		string 	`json:"regState"`
 	Address   		string  `json:"address"`
 	City     		string  `json:"city"`
@@ -119,7 +137,14 @@ type Company struct {
 	State    		string  `json:"state"`
 	UrlLinks      []UrlLink `json:"urlLinks"`
 	Registrator    	string  `json:"registrator"`
-	RegisterDate 	string  `json:"registerDate"`
+	EnrollmentID 	string  `json:"enrollmentId,omitempty"`
+	RegisterDate 	Timestamp `json:"registerDate"`
+	EffectiveDate 	Timestamp `json:"effectiveDate,omitempty"`
+	Status 			string  `json:"status"`
+	StatusHistory []StatusChange `json:"statusHistory"`
+	MergedInto 		string  `json:"mergedInto,omitempty"`
+	MergedFrom 		[]string `json:"mergedFrom,omitempty"`
+	RedirectedFrom 	string  `json:"redirectedFrom,omitempty"`
 }
 /************* ID-Man **************************/
 
@@ -138,7 +163,8 @@ type CP struct {
 	Maturity  int     `json:"maturity"`
 	Owners    []Owner `json:"owner"`
 	Issuer    string  `json:"issuer"`
-	IssueDate string  `json:"issueDate"`
+	IssueDate Timestamp `json:"issueDate"`
+	EffectiveDate Timestamp `json:"effectiveDate,omitempty"`
 }
 
 type Account struct {
@@ -146,6 +172,8 @@ type Account struct {
 	Prefix      string  `json:"prefix"`
 	CashBalance float64 `json:"cashBalance"`
 	AssetsIds   []string `json:"assetIds"`
+	OwnerType   string  `json:"ownerType"`	// "person" or "company" (ID-Man)
+	OwnerID     string  `json:"ownerId"`	// verified Person/Company ID (ID-Man)
 }
 
 type Transaction struct {
@@ -198,6 +226,38 @@ func (t *SimpleChaincode) Init(stub *shim.ChaincodeStub, function string, args [
     } else {
         fmt.Println("Found company keyBytes. Will not overwrite keys.")
     }
+
+    // Give records registered before status lists existed a status list index
+    fmt.Println("Indexing status lists")
+    err := indexStatusLists(stub)
+    if err != nil {
+        fmt.Println("Failed to index status lists")
+        return nil, err
+    }
+
+    // Hash the claims of persons registered before claims were hashed
+    fmt.Println("Hashing legacy person claims")
+    err = hashLegacyClaims(stub)
+    if err != nil {
+        fmt.Println("Failed to hash legacy person claims")
+        return nil, err
+    }
+
+    // Signing seeds are no longer kept on the ledger
+    fmt.Println("Removing legacy attestation seed")
+    err = removeLegacyAttestationSeed(stub)
+    if err != nil {
+        fmt.Println("Failed to remove legacy attestation seed")
+        return nil, err
+    }
+
+    // Build the unique indexes of records registered before they existed
+    fmt.Println("Indexing legacy persons and companies")
+    err = indexLegacyRecords(stub)
+    if err != nil {
+        fmt.Println("Failed to index legacy persons and companies")
+        return nil, err
+    }
 /************* ID-Man **************************/    
 	
 	fmt.Println("Initialization complete")
@@ -206,18 +266,41 @@ func (t *SimpleChaincode) Init(stub *shim.ChaincodeStub, function string, args [
 
 func (t *SimpleChaincode) createAccounts(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
 
-	//  				0
-	// "number of accounts to create"
+	//  				0								1
+	// "number of accounts to create"	"json array of company claims, one per account"
+	if len(args) != 2 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("createAccounts accepts an integer and an array of company claims")
+	}
 	var err error
 	numAccounts, err := strconv.Atoi(args[0])
 	if err != nil {
 		fmt.Println("error creating accounts with input")
-		return nil, errors.New("createAccounts accepts a single integer argument")
+		return nil, errors.New("createAccounts expects the number of accounts as an integer first argument")
+	}
+
+	// Every account must belong to a registered and verified company
+	var claims []json.RawMessage
+	err = json.Unmarshal([]byte(args[1]), &claims)
+	if err != nil {
+		fmt.Println("error unmarshalling company claims")
+		return nil, errors.New("createAccounts expects a json array of company claims")
 	}
+	if len(claims) != numAccounts {
+		fmt.Println("number of company claims doesn't match number of accounts")
+		return nil, errors.New("Expecting " + strconv.Itoa(numAccounts) + " company claims, got " + strconv.Itoa(len(claims)))
+	}
+
 	//create a bunch of accounts
 	var account Account
 	counter := 1
 	for counter <= numAccounts {
+		companyID, err := verifyAccountOwner(stub, ownerTypeCompany, string(claims[counter-1]))
+		if err != nil {
+			fmt.Println("error verifying owner of account company" + strconv.Itoa(counter))
+			return nil, errors.New("Can't create account company" + strconv.Itoa(counter) + ": " + err.Error())
+		}
+
 		var prefix string
 		suffix := "000A"
 		if counter < 10 {
@@ -226,7 +309,7 @@ func (t *SimpleChaincode) createAccounts(stub *shim.ChaincodeStub, args []string
 			prefix = strconv.Itoa(counter) + suffix
 		}
 		var assetIds []string
-		account = Account{ID: "company" + strconv.Itoa(counter), Prefix: prefix, CashBalance: 10000000.0, AssetsIds: assetIds}
+		account = Account{ID: "company" + strconv.Itoa(counter), Prefix: prefix, CashBalance: 10000000.0, AssetsIds: assetIds, OwnerType: ownerTypeCompany, OwnerID: companyID}
 		accountBytes, err := json.Marshal(&account)
 		if err != nil {
 			fmt.Println("error creating account" + account.ID)
@@ -234,7 +317,7 @@ func (t *SimpleChaincode) createAccounts(stub *shim.ChaincodeStub, args []string
 		}
 		err = stub.PutState(accountPrefix+account.ID, accountBytes)
 		counter++
-		fmt.Println("created account" + accountPrefix + account.ID)
+		fmt.Println("created account" + accountPrefix + account.ID + " owned by " + companyID)
 	}
 
 	fmt.Println("Accounts created")
@@ -243,18 +326,28 @@ func (t *SimpleChaincode) createAccounts(stub *shim.ChaincodeStub, args []string
 }
 
 func (t *SimpleChaincode) createAccount(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+    /*      0           1                       2
+        "username"  "person" or "company"   json claims of the owner, as for VerifyPerson/VerifyCompany
+    */
     // Obtain the username to associate with the account
-    if len(args) != 1 {
+    if len(args) != 3 {
         fmt.Println("Error obtaining username")
-        return nil, errors.New("createAccount accepts a single username argument")
+        return nil, errors.New("createAccount accepts a username, an owner type and the owner's claims")
     }
     username := args[0]
+
+    // The owner must be registered and pass verification before trading
+    ownerID, err := verifyAccountOwner(stub, args[1], args[2])
+    if err != nil {
+        fmt.Println("Error verifying owner of account " + username)
+        return nil, errors.New("Can't create account " + username + ": " + err.Error())
+    }
     
     // Build an account object for the user
     var assetIds []string
     suffix := "000A"
     prefix := username + suffix
-    var account = Account{ID: username, Prefix: prefix, CashBalance: 10000000.0, AssetsIds: assetIds}
+    var account = Account{ID: username, Prefix: prefix, CashBalance: 10000000.0, AssetsIds: assetIds, OwnerType: args[1], OwnerID: ownerID}
     accountBytes, err := json.Marshal(&account)
     if err != nil {
         fmt.Println("error creating account" + account.ID)
@@ -305,34 +398,38 @@ func (t *SimpleChaincode) createAccount(stub *shim.ChaincodeStub, args []string)
 }
 
 /******* ID-Man *********************/
-func (t *SimpleChaincode) registerPerson(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+// personID derives the ID of a person from its names
+func personID(person Person) string {
+	return idcheck.PersonID(person.FirstName, person.LastName)
+}
 
-	//need one arg
-	if len(args) != 1 {
-		fmt.Println("error invalid arguments")
-		return nil, errors.New("Incorrect number of arguments. Expecting person record")
-	}
+// companyID derives the ID of a company from its name
+func companyID(company Company) string {
+	return idcheck.CompanyID(company.Name)
+}
 
+// checkNewPerson reads and validates a person record to register and fills
+// in what the registry sets. It writes nothing to the ledger.
+func checkNewPerson(stub *shim.ChaincodeStub, record string) (Person, error) {
 	var person Person
 	var err error
 
 	fmt.Println("Unmarshalling Person")
-	err = json.Unmarshal([]byte(args[0]), &person)
+	err = json.Unmarshal([]byte(record), &person)
 	if err != nil {
 		fmt.Println("error invalid person register")
-		return nil, errors.New("Invalid Person register")
+		return person, errors.New("Invalid Person register")
 	}
 
 	//generate the Person ID
-	person.ID = strings.ToLower(person.FirstName) + strings.ToLower(person.LastName)
-	person.ID = strings.Replace(person.ID, " ", "", -1) //remove all spaces
+	person.ID = personID(person)
 	//var stringHash := person.FirstName + person.LastName + person.BirthDate + person.Email + person.Gender
     //person.ID, err = genHash(stringHash)
     fmt.Println("Person ID is: ", person.ID)
 
     if person.ID == "" {
         fmt.Println("No Person ID, returning error")
-        return nil, errors.New("Person ID cannot be blank")
+        return person, errors.New("Person ID cannot be blank")
     }
     fmt.Println("Person ID is: ", person.ID)
     fmt.Println("Person FirstName is: ", person.FirstName)
@@ -344,63 +441,137 @@ func (t *SimpleChaincode) registerPerson(stub *shim.ChaincodeStub, args []string
     fmt.Println("Person City is: ", person.City)
     fmt.Println("Person Postcode is: ", person.Postcode)
     fmt.Println("Person State is: ", person.State)
+	err = checkRegistrator(stub, &person.Registrator, person.EnrollmentID)
+	if err != nil {
+		return person, err
+	}
     fmt.Println("Registrator is: ", person.Registrator)
     fmt.Println("RegisterDate is: ", person.RegisterDate)
 
-	fmt.Println("Marshalling Person bytes")
-	fmt.Println("Getting State on Person " + person.ID)
-	persRxBytes, err := stub.GetState(personPrefix+person.ID)
+	err = preparePersonDates(stub, &person)
+	if err != nil {
+		fmt.Println("Invalid dates of person " + person.ID)
+		return person, err
+	}
 
-	if persRxBytes == nil {
+	err = validateUrlLinks(person.UrlLinks)
+	if err != nil {
+		fmt.Println("Invalid links of person " + person.ID)
+		return person, err
+	}
 
-		fmt.Println("ID does not exist, creating it")
-		persBytes, err := json.Marshal(&person)
-		if err != nil {
-			fmt.Println("Error marshalling person")
-			return nil, errors.New("Error registering person")
+	// The same person must not be registered twice under another name
+	err = checkUniqueIndexes(stub, ownerTypePerson, person.ID, personIndexValues(person))
+	if err != nil {
+		fmt.Println("Person " + person.ID + " clashes with a registered person")
+		return person, err
+	}
+
+	// Only a reference to a photo in the photo store goes on the ledger
+	err = preparePersonPhoto(&person)
+	if err != nil {
+		fmt.Println("Error storing photo of person " + person.ID)
+		return person, err
+	}
+
+	person.Status = statusPending
+	person.StatusHistory = nil
+	err = hashPersonClaims(stub, &person)
+	if err != nil {
+		return person, err
+	}
+
+	return person, nil
+}
+
+// putNewPerson writes a checked person that isn't registered yet, with its
+// key, status list entry, indexes and photo reference
+func putNewPerson(stub *shim.ChaincodeStub, person Person) error {
+	persBytes, err := json.Marshal(&person)
+	if err != nil {
+		fmt.Println("Error marshalling person")
+		return errors.New("Error registering person")
+	}
+	err = stub.PutState(personPrefix+person.ID, persBytes)
+	if err != nil {
+		fmt.Println("Error registering person")
+		return errors.New("Error registering person")
+	}
+	
+	// Update the person keys by adding the new key
+	fmt.Println("Getting Person Keys")
+	keysBytes, err := stub.GetState(personKeysID)
+	if err != nil {
+		fmt.Println("Error retrieving person keys")
+		return errors.New("Error retrieving person keys")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshel keys")
+		return errors.New("Error unmarshalling person keys ")
+	}
+	
+	fmt.Println("Appending the new key to Person Keys")
+	foundKey := false
+	for _, key := range keys {
+		if key == personPrefix+person.ID {
+			foundKey = true
 		}
-		err = stub.PutState(personPrefix+person.ID, persBytes)
+	}
+	if foundKey == false {
+		keys = append(keys, personPrefix+person.ID)
+		keysBytesToWrite, err := json.Marshal(&keys)
 		if err != nil {
-			fmt.Println("Error registering person")
-			return nil, errors.New("Error registering person")
+			fmt.Println("Error marshalling keys")
+			return errors.New("Error marshalling the keys")
 		}
-		
-		// Update the person keys by adding the new key
-		fmt.Println("Getting Person Keys")
-		keysBytes, err := stub.GetState(personKeysID)
+		fmt.Println("Put state on PersKeys")
+		err = stub.PutState(personKeysID, keysBytesToWrite)
 		if err != nil {
-			fmt.Println("Error retrieving person keys")
-			return nil, errors.New("Error retrieving person keys")
+			fmt.Println("Error writting keys back")
+			return errors.New("Error writing the keys back")
 		}
-		var keys []string
-		err = json.Unmarshal(keysBytes, &keys)
+	}
+	
+	err = addToStatusList(stub, ownerTypePerson, person.ID)
+	if err != nil {
+		return err
+	}
+
+	err = putIndexes(stub, ownerTypePerson, person.ID, personIndexValues(person))
+	if err != nil {
+		return err
+	}
+
+	return countPhotoRef(stub, person.Photo, 1)
+}
+
+func (t *SimpleChaincode) registerPerson(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	//need one arg
+	if len(args) != 1 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting person record")
+	}
+
+	person, err := checkNewPerson(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Marshalling Person bytes")
+	fmt.Println("Getting State on Person " + person.ID)
+	persRxBytes, err := stub.GetState(personPrefix+person.ID)
+
+	if persRxBytes == nil {
+
+		fmt.Println("ID does not exist, creating it")
+		err = putNewPerson(stub, person)
 		if err != nil {
-			fmt.Println("Error unmarshel keys")
-			return nil, errors.New("Error unmarshalling person keys ")
-		}
-		
-		fmt.Println("Appending the new key to Person Keys")
-		foundKey := false
-		for _, key := range keys {
-			if key == personPrefix+person.ID {
-				foundKey = true
-			}
-		}
-		if foundKey == false {
-			keys = append(keys, personPrefix+person.ID)
-			keysBytesToWrite, err := json.Marshal(&keys)
-			if err != nil {
-				fmt.Println("Error marshalling keys")
-				return nil, errors.New("Error marshalling the keys")
-			}
-			fmt.Println("Put state on PersKeys")
-			err = stub.PutState(personKeysID, keysBytesToWrite)
-			if err != nil {
-				fmt.Println("Error writting keys back")
-				return nil, errors.New("Error writing the keys back")
-			}
+			return nil, err
 		}
-		
+
 		fmt.Println("Register person %+v\n", person)
 		return nil, nil
 
@@ -440,7 +611,9 @@ func (t *SimpleChaincode) registerPerson(stub *shim.ChaincodeStub, args []string
 }
 
 
-func GetAllPersons(stub *shim.ChaincodeStub) ([]Person, error){
+// GetAllPersons returns all registered persons, or only those with the given
+// status when status is not blank
+func GetAllPersons(stub *shim.ChaincodeStub, status string) ([]Person, error){
     
     var allPersons []Person
     
@@ -467,6 +640,9 @@ func GetAllPersons(stub *shim.ChaincodeStub) ([]Person, error){
             fmt.Println("Error retrieving person " + value)
             return nil, errors.New("Error retrieving person " + value)
         }
+        if status != "" && effectiveStatus(person.Status) != status {
+            continue
+        }
         
         fmt.Println("Appending Person" + value)
         allPersons = append(allPersons, person)
@@ -486,76 +662,77 @@ func GetPerson(personId string, stub *shim.ChaincodeStub) (Person, error){
         fmt.Println("Error retrieving person " + personId)
         return person, errors.New("Error retrieving person " + personId)
     }
+
+    // Follow the redirect mergePersons left at a duplicate
+    if person.MergedInto != "" {
+        return followPersonRedirect(stub, person)
+    }
     
     return person, nil
 }
 
-func VerifyPerson(stub *shim.ChaincodeStub, sPerson string) (Person, error){
+// VerifyPerson compares the claimed fields of a person with the registry and
+// returns a per-field report. A mismatch is reported, not returned as an error.
+func VerifyPerson(stub *shim.ChaincodeStub, sPerson string) (VerificationReport, error){
 
     var err error
     var person Person
+    var report VerificationReport
 
     err = json.Unmarshal([]byte(sPerson), &person)
 
     if err != nil {
-        return person, errors.New("Error unmarshalling verifying person")
+        return report, errors.New("Error unmarshalling verifying person")
     }
 
 	//generate the person ID
-	person.ID = strings.ToLower(person.FirstName) + strings.ToLower(person.LastName)
-	person.ID = strings.Replace(person.ID, " ", "", -1) //remove all spaces
+	person.ID = personID(person)
     fmt.Println("person ID is: ", person.ID)
 
     if person.ID == "" {
         fmt.Println("No person ID, returning error")
-        return person, errors.New("person ID cannot be blank")
+        return report, errors.New("person ID cannot be blank")
     }
+    report.SubjectType = ownerTypePerson
+    report.SubjectID = person.ID
 
     //Read existing person
     var personDB Person
 
 	personDB, errDB := GetPerson(person.ID, stub)
 	if errDB != nil {
-		return person, errors.New("Person " + person.ID + " not found")
+		return report, errors.New("Person " + person.ID + " not found")
 	}
-
-	//Verifications (we don't check names. cause it's a part of the key)
-	if 	(person.Email != personDB.Email) || (person.BirthDate != personDB.BirthDate) || (person.DrivingLicence != personDB.DrivingLicence) {
-
-		return person, errors.New("Person verification failed")
+	if effectiveStatus(personDB.Status) != statusActive {
+		return report, errors.New("Person " + person.ID + " is " + personDB.Status + ", only active persons can be verified")
 	}
 
-	return personDB, nil
+	//Verifications (we don't check names. cause it's a part of the key)
+	return comparePerson(stub, person, personDB)
 }
 
-func (t *SimpleChaincode) registerCompany(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
-
-	//need one arg
-	if len(args) != 1 {
-		fmt.Println("error invalid arguments")
-		return nil, errors.New("Incorrect number of arguments. Expecting company record")
-	}
-
+// checkNewCompany reads and validates a company record to register and fills
+// in what the registry sets. It writes nothing to the ledger.
+func checkNewCompany(stub *shim.ChaincodeStub, record string) (Company, error) {
 	var company Company
 	var err error
 
 	fmt.Println("Unmarshalling company")
-	err = json.Unmarshal([]byte(args[0]), &company)
+	err = json.Unmarshal([]byte(record), &company)
 	if err != nil {
 		fmt.Println("error invalid company register")
-		return nil, errors.New("Invalid company register")
+		return company, errors.New("Invalid company register")
 	}
 
 	//generate the company ID
-	company.ID = strings.ToLower(company.Name)
-	company.ID = strings.Replace(company.ID, " ", "", -1) //remove all spaces
+	company.ID = companyID(company)
 	//var stringHash := person.FirstName + person.LastName + person.BirthDate + person.Email + person.Gender
     //person.ID, err = genHash(stringHash)
     fmt.Println("company ID is: ", company.ID)
 
     if company.ID == "" {
         fmt.Println("No company ID, returning error")
-        return nil, errors.New("company ID cannot be blank")
+        return company, errors.New("company ID cannot be blank")
     }
     fmt.Println("company ID is: ", company.ID)
     fmt.Println("company FirstName is: ", company.Name)
@@ -567,63 +744,121 @@ func (t *SimpleChaincode) registerCompany(stub *shim.ChaincodeStub, args []strin
     fmt.Println("company City is: ", company.City)
     fmt.Println("company Postcode is: ", company.Postcode)
     fmt.Println("company State is: ", company.State)
+	err = checkRegistrator(stub, &company.Registrator, company.EnrollmentID)
+	if err != nil {
+		return company, err
+	}
     fmt.Println("Registrator is: ", company.Registrator)
     fmt.Println("RegisterDate is: ", company.RegisterDate)
 
-	fmt.Println("Marshalling company bytes")
-	fmt.Println("Getting State on company " + company.ID)
-	compRxBytes, err := stub.GetState(companyPrefix+company.ID)
+	err = prepareCompanyDates(stub, &company)
+	if err != nil {
+		fmt.Println("Invalid dates of company " + company.ID)
+		return company, err
+	}
 
-	if compRxBytes == nil {
+	err = validateUrlLinks(company.UrlLinks)
+	if err != nil {
+		fmt.Println("Invalid links of company " + company.ID)
+		return company, err
+	}
 
-		fmt.Println("ID does not exist, creating it")
-		compBytes, err := json.Marshal(&company)
-		if err != nil {
-			fmt.Println("Error marshalling company")
-			return nil, errors.New("Error registering company")
+	// The same company must not be registered twice under another name
+	err = checkUniqueIndexes(stub, ownerTypeCompany, company.ID, companyIndexValues(company))
+	if err != nil {
+		fmt.Println("Company " + company.ID + " clashes with a registered company")
+		return company, err
+	}
+
+	company.Status = statusPending
+	company.StatusHistory = nil
+
+	return company, nil
+}
+
+// putNewCompany writes a checked company that isn't registered yet, with its
+// key, status list entry and indexes
+func putNewCompany(stub *shim.ChaincodeStub, company Company) error {
+	compBytes, err := json.Marshal(&company)
+	if err != nil {
+		fmt.Println("Error marshalling company")
+		return errors.New("Error registering company")
+	}
+	err = stub.PutState(companyPrefix+company.ID, compBytes)
+	if err != nil {
+		fmt.Println("Error registering company")
+		return errors.New("Error registering company")
+	}
+	
+	// Update the company keys by adding the new key
+	fmt.Println("Getting company Keys")
+	keysBytes, err := stub.GetState(companyKeysID)
+	if err != nil {
+		fmt.Println("Error retrieving company keys")
+		return errors.New("Error retrieving company keys")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshel keys")
+		return errors.New("Error unmarshalling company keys ")
+	}
+	
+	fmt.Println("Appending the new key to company Keys")
+	foundKey := false
+	for _, key := range keys {
+		if key == companyPrefix+company.ID {
+			foundKey = true
 		}
-		err = stub.PutState(companyPrefix+company.ID, compBytes)
+	}
+	if foundKey == false {
+		keys = append(keys, companyPrefix+company.ID)
+		keysBytesToWrite, err := json.Marshal(&keys)
 		if err != nil {
-			fmt.Println("Error registering company")
-			return nil, errors.New("Error registering company")
+			fmt.Println("Error marshalling keys")
+			return errors.New("Error marshalling the keys")
 		}
-		
-		// Update the company keys by adding the new key
-		fmt.Println("Getting company Keys")
-		keysBytes, err := stub.GetState(companyKeysID)
+		fmt.Println("Put state on company Keys")
+		err = stub.PutState(companyKeysID, keysBytesToWrite)
 		if err != nil {
-			fmt.Println("Error retrieving company keys")
-			return nil, errors.New("Error retrieving company keys")
+			fmt.Println("Error writting company keys back")
+			return errors.New("Error writing the company keys back")
 		}
-		var keys []string
-		err = json.Unmarshal(keysBytes, &keys)
+	}
+	
+	err = addToStatusList(stub, ownerTypeCompany, company.ID)
+	if err != nil {
+		return err
+	}
+
+	return putIndexes(stub, ownerTypeCompany, company.ID, companyIndexValues(company))
+}
+
+func (t *SimpleChaincode) registerCompany(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	//need one arg
+	if len(args) != 1 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting company record")
+	}
+
+	company, err := checkNewCompany(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Marshalling company bytes")
+	fmt.Println("Getting State on company " + company.ID)
+	compRxBytes, err := stub.GetState(companyPrefix+company.ID)
+
+	if compRxBytes == nil {
+
+		fmt.Println("ID does not exist, creating it")
+		err = putNewCompany(stub, company)
 		if err != nil {
-			fmt.Println("Error unmarshel keys")
-			return nil, errors.New("Error unmarshalling company keys ")
-		}
-		
-		fmt.Println("Appending the new key to company Keys")
-		foundKey := false
-		for _, key := range keys {
-			if key == companyPrefix+company.ID {
-				foundKey = true
-			}
-		}
-		if foundKey == false {
-			keys = append(keys, companyPrefix+company.ID)
-			keysBytesToWrite, err := json.Marshal(&keys)
-			if err != nil {
-				fmt.Println("Error marshalling keys")
-				return nil, errors.New("Error marshalling the keys")
-			}
-			fmt.Println("Put state on company Keys")
-			err = stub.PutState(companyKeysID, keysBytesToWrite)
-			if err != nil {
-				fmt.Println("Error writting company keys back")
-				return nil, errors.New("Error writing the company keys back")
-			}
+			return nil, err
 		}
-		
+
 		fmt.Println("Register company %+v\n", company)
 		return nil, nil
 
@@ -663,7 +898,9 @@ func (t *SimpleChaincode) registerCompany(stub *shim.ChaincodeStub, args []strin
 }
 
 
-func GetAllCompanies(stub *shim.ChaincodeStub) ([]Company, error){
+// GetAllCompanies returns all registered companies, or only those with the
+// given status when status is not blank
+func GetAllCompanies(stub *shim.ChaincodeStub, status string) ([]Company, error){
     
     var allCompanies []Company
     
@@ -690,6 +927,9 @@ func GetAllCompanies(stub *shim.ChaincodeStub) ([]Company, error){
             fmt.Println("Error retrieving company " + value)
             return nil, errors.New("Error retrieving company " + value)
         }
+        if status != "" && effectiveStatus(company.Status) != status {
+            continue
+        }
         
         fmt.Println("Appending company" + value)
         allCompanies = append(allCompanies, company)
@@ -709,62 +949,146 @@ func GetCompany(companyId string, stub *shim.ChaincodeStub) (Company, error){
         fmt.Println("Error retrieving company " + companyId)
         return company, errors.New("Error retrieving company " + companyId)
     }
+
+    // Follow the redirect mergeCompanies left at a duplicate
+    if company.MergedInto != "" {
+        return followCompanyRedirect(stub, company)
+    }
     
     return company, nil
 }
 
-func VerifyCompany(stub *shim.ChaincodeStub, sCompany string) (Company, error){
+// VerifyCompany compares the claimed fields of a company with the registry and
+// returns a per-field report. A mismatch is reported, not returned as an error.
+func VerifyCompany(stub *shim.ChaincodeStub, sCompany string) (VerificationReport, error){
 
     //sCompany = "{\"id\":\"test ltd\",\"name\":\"Test Ltd\"}"
 
     var err error
     var company Company
+    var report VerificationReport
 
     err = json.Unmarshal([]byte(sCompany), &company)
 
     if err != nil {
         fmt.Println("Error retrieving company  + companyId")
-        return company, errors.New("Error retrieving company  + companyId")
+        return report, errors.New("Error retrieving company  + companyId")
     }
 
 	//generate the company ID
-	company.ID = strings.ToLower(company.Name)
-	company.ID = strings.Replace(company.ID, " ", "", -1) //remove all spaces
+	company.ID = companyID(company)
     fmt.Println("company ID is: ", company.ID)
 
     if company.ID == "" {
         fmt.Println("No company ID, returning error")
-        return company, errors.New("company ID cannot be blank")
+        return report, errors.New("company ID cannot be blank")
     }
+    report.SubjectType = ownerTypeCompany
+    report.SubjectID = company.ID
 
     //Read existing company
     var companyDB Company
 
 	companyDB, errDB := GetCompany(company.ID, stub)
 	if errDB != nil {
-		return company, errors.New("Company " + company.ID + " not found")
+		return report, errors.New("Company " + company.ID + " not found")
+	}
+	if effectiveStatus(companyDB.Status) != statusActive {
+		return report, errors.New("Company " + company.ID + " is " + companyDB.Status + ", only active companies can be verified")
 	}
 
 	//Verifications (we don't check name. cause it's a part of the key)
-	if 	(company.RegDate != companyDB.RegDate) || (company.RegState != companyDB.RegState) || (company.ACN != companyDB.ACN) || (company.ABN != companyDB.ABN) {
+	return compareCompany(stub, company, companyDB)
+}
+
+// verifyAccountOwner checks the claims of a prospective account owner against
+// the Person/Company registry and returns the verified ID to link the account to.
+func verifyAccountOwner(stub *shim.ChaincodeStub, ownerType string, claims string) (string, error) {
+
+	var report VerificationReport
+	var err error
 
-		return company, errors.New("Company verification failed")
+	if ownerType == ownerTypePerson {
+		report, err = VerifyPerson(stub, claims)
+	} else if ownerType == ownerTypeCompany {
+		report, err = VerifyCompany(stub, claims)
+	} else {
+		return "", errors.New("Unknown account owner type " + ownerType + ", expecting person or company")
+	}
+	if err != nil {
+		fmt.Println("Account owner failed " + ownerType + " verification")
+		return "", err
+	}
+	if report.Passed == false {
+		fmt.Println("Account owner failed " + ownerType + " verification")
+		return "", errors.New("Verification of " + ownerType + " " + report.SubjectID + " failed")
 	}
 
-	return companyDB, nil
+	return report.SubjectID, nil
 }
 
-/******* ID-Man *********************/
+// checkAccountCompliance looks up the identity record linked to an account and
+// fails unless it exists and is active. Paper can't be issued to, or moved to
+// or from, an account without a current identity record.
+func checkAccountCompliance(stub *shim.ChaincodeStub, account Account) error {
 
+	if account.OwnerID == "" {
+		return errors.New("Compliance error: account " + account.ID + " is not linked to a registered identity")
+	}
 
-func (t *SimpleChaincode) issueCommercialPaper(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	var status string
+	if account.OwnerType == ownerTypeCompany {
+		company, err := GetCompany(account.OwnerID, stub)
+		if err != nil {
+			return errors.New("Compliance error: company " + account.OwnerID + " of account " + account.ID + " is not registered")
+		}
+		status = company.Status
+	} else if account.OwnerType == ownerTypePerson {
+		person, err := GetPerson(account.OwnerID, stub)
+		if err != nil {
+			return errors.New("Compliance error: person " + account.OwnerID + " of account " + account.ID + " is not registered")
+		}
+		status = person.Status
+	} else {
+		return errors.New("Compliance error: account " + account.ID + " has unknown owner type " + account.OwnerType)
+	}
 
-	/*		0
-		json
-	  	{
-			"ticker":  "string",
-			"par": 0.00,
-			"qty": 10,
+	if effectiveStatus(status) != statusActive {
+		return errors.New("Compliance error: owner " + account.OwnerID + " of account " + account.ID + " is " + status)
+	}
+
+	return nil
+}
+
+// checkCounterpartyCompliance loads the account of a counterparty and checks it
+// with checkAccountCompliance.
+func checkCounterpartyCompliance(stub *shim.ChaincodeStub, accountID string) error {
+
+	accountBytes, err := stub.GetState(accountPrefix + accountID)
+	if err != nil || accountBytes == nil {
+		return errors.New("Compliance error: no account found for " + accountID)
+	}
+
+	var account Account
+	err = json.Unmarshal(accountBytes, &account)
+	if err != nil {
+		return errors.New("Error unmarshalling account " + accountID)
+	}
+
+	return checkAccountCompliance(stub, account)
+}
+
+/******* ID-Man *********************/
+
+
+func (t *SimpleChaincode) issueCommercialPaper(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	/*		0
+		json
+	  	{
+			"ticker":  "string",
+			"par": 0.00,
+			"qty": 10,
 			"discount": 7.5,
 			"maturity": 30,
 			"owners": [ // This one is not required
@@ -782,7 +1106,7 @@ func (t *SimpleChaincode) issueCommercialPaper(stub *shim.ChaincodeStub, args []
 				}
 			],				
 			"issuer":"company2",
-			"issueDate":"1456161763790"  (current time in milliseconds as a string)
+			"effectiveDate":"1456161763790"  (optional, epoch milliseconds or ISO-8601; issueDate is set from the transaction)
 
 		}
 	*/
@@ -803,6 +1127,13 @@ func (t *SimpleChaincode) issueCommercialPaper(stub *shim.ChaincodeStub, args []
 		return nil, errors.New("Invalid commercial paper issue")
 	}
 
+	// The paper is issued now; the date the client supplied is its effective date
+	err = stampTxTime(stub, "issueDate", &cp.IssueDate, &cp.EffectiveDate)
+	if err != nil {
+		fmt.Println("Invalid effective date " + string(cp.EffectiveDate))
+		return nil, err
+	}
+
 	//generate the CUSIP
 	//get account prefix
 	fmt.Println("Getting state of - " + accountPrefix + cp.Issuer)
@@ -817,6 +1148,20 @@ func (t *SimpleChaincode) issueCommercialPaper(stub *shim.ChaincodeStub, args []
 		return nil, errors.New("Error retrieving account " + cp.Issuer)
 	}
 	
+	// The issuer and any initial owners must have a current identity record
+	err = checkAccountCompliance(stub, account)
+	if err != nil {
+		fmt.Println("Issuer " + cp.Issuer + " failed compliance check")
+		return nil, err
+	}
+	for _, o := range cp.Owners {
+		err = checkCounterpartyCompliance(stub, o.Company)
+		if err != nil {
+			fmt.Println("Owner " + o.Company + " failed compliance check")
+			return nil, err
+		}
+	}
+
 	account.AssetsIds = append(account.AssetsIds, cp.CUSIP)
 
 	// Set the issuer to be the owner of all quantity
@@ -1083,6 +1428,18 @@ func (t *SimpleChaincode) transferPaper(stub *shim.ChaincodeStub, args []string)
 		return nil, errors.New("Error unmarshalling account " + tr.ToCompany)
 	}
 
+	// Both counterparties must have a current identity record
+	err = checkAccountCompliance(stub, fromCompany)
+	if err != nil {
+		fmt.Println("FromCompany " + tr.FromCompany + " failed compliance check")
+		return nil, err
+	}
+	err = checkAccountCompliance(stub, toCompany)
+	if err != nil {
+		fmt.Println("ToCompany " + tr.ToCompany + " failed compliance check")
+		return nil, err
+	}
+
 	// Check for all the possible errors
 	ownerFound := false 
 	quantity := 0
@@ -1232,11 +1589,22 @@ func (t *SimpleChaincode) Query(stub *shim.ChaincodeStub, function string, args
 /************* ID-Man **************************/	
 	} else if args[0] == "GetAllPersons" {
 		fmt.Println("Getting all Persons")
-		allPersons, err := GetAllPersons(stub)
+		status, err := statusFilterArg(args)
+		if err != nil {
+			return nil, err
+		}
+		allPersons, err := GetAllPersons(stub, status)
 		if err != nil {
 			fmt.Println("Error from GetAllPersons")
 			return nil, err
 		} else {
+			// Only show the caller what it has consent for
+			for i := range allPersons {
+				allPersons[i], err = filterPersonByConsent(stub, allPersons[i])
+				if err != nil {
+					return nil, err
+				}
+			}
 			allPersonsBytes, err1 := json.Marshal(&allPersons)
 			if err1 != nil {
 				fmt.Println("Error marshalling allPersons")
@@ -1249,10 +1617,17 @@ func (t *SimpleChaincode) Query(stub *shim.ChaincodeStub, function string, args
 	} else if args[0] == "GetPerson" {
 		fmt.Println("Getting particular person")
 		person, err := GetPerson(args[1], stub)
+		if err == nil {
+			// Only show the relying party what it has consent for
+			person, err = filterPersonByConsent(stub, person)
+		}
 		if err != nil {
 			fmt.Println("Error Getting particular person")
 			return nil, err
 		} else {
+			if person.ID != args[1] {
+				person.RedirectedFrom = args[1]
+			}
 			personBytes, err1 := json.Marshal(&person)
 			if err1 != nil {
 				fmt.Println("Error marshalling the person")
@@ -1264,11 +1639,18 @@ func (t *SimpleChaincode) Query(stub *shim.ChaincodeStub, function string, args
 
 	} else if args[0] == "GetAllCompanies" {
 		fmt.Println("Getting all Companies")
-		allCompanies, err := GetAllCompanies(stub)
+		status, err := statusFilterArg(args)
+		if err != nil {
+			return nil, err
+		}
+		allCompanies, err := GetAllCompanies(stub, status)
 		if err != nil {
 			fmt.Println("Error from GetAllCompanies")
 			return nil, err
 		} else {
+			for i := range allCompanies {
+				allCompanies[i] = filterCompany(stub, allCompanies[i])
+			}
 			allCompaniesBytes, err1 := json.Marshal(&allCompanies)
 			if err1 != nil {
 				fmt.Println("Error marshalling allCompanies")
@@ -1285,6 +1667,10 @@ func (t *SimpleChaincode) Query(stub *shim.ChaincodeStub, function string, args
 			fmt.Println("Error from getCompany")
 			return nil, err
 		} else {
+			if company.ID != args[1] {
+				company.RedirectedFrom = args[1]
+			}
+			company = filterCompany(stub, company)
 			companyBytes, err1 := json.Marshal(&company)
 			if err1 != nil {
 				fmt.Println("Error marshalling the company")
@@ -1294,42 +1680,584 @@ func (t *SimpleChaincode) Query(stub *shim.ChaincodeStub, function string, args
 			return companyBytes, nil		 
 		}
 
+	} else if args[0] == "FindPersonByEmail" {
+		fmt.Println("Finding a person by email")
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting email")
+		}
+		person, err := FindPerson(stub, "email", args[1])
+		if err == nil {
+			// Only show the relying party what it has consent for
+			person, err = filterPersonByConsent(stub, person)
+		}
+		if err != nil {
+			fmt.Println("Error from FindPersonByEmail")
+			return nil, err
+		} else {
+			personBytes, err1 := json.Marshal(&person)
+			if err1 != nil {
+				fmt.Println("Error marshalling the person")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the person")
+			return personBytes, nil
+		}
+
+	} else if args[0] == "FindPersonByLicence" {
+		fmt.Println("Finding a person by driving licence")
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting driving licence")
+		}
+		person, err := FindPerson(stub, "drivingLicence", args[1])
+		if err == nil {
+			// Only show the relying party what it has consent for
+			person, err = filterPersonByConsent(stub, person)
+		}
+		if err != nil {
+			fmt.Println("Error from FindPersonByLicence")
+			return nil, err
+		} else {
+			personBytes, err1 := json.Marshal(&person)
+			if err1 != nil {
+				fmt.Println("Error marshalling the person")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the person")
+			return personBytes, nil
+		}
+
+	} else if args[0] == "FindCompanyByABN" {
+		fmt.Println("Finding a company by ABN")
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting ABN")
+		}
+		company, err := FindCompany(stub, "abn", args[1])
+		if err != nil {
+			fmt.Println("Error from FindCompanyByABN")
+			return nil, err
+		} else {
+			company = filterCompany(stub, company)
+			companyBytes, err1 := json.Marshal(&company)
+			if err1 != nil {
+				fmt.Println("Error marshalling the company")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the company")
+			return companyBytes, nil
+		}
+
+	} else if args[0] == "FindCompanyByACN" {
+		fmt.Println("Finding a company by ACN")
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting ACN")
+		}
+		company, err := FindCompany(stub, "acn", args[1])
+		if err != nil {
+			fmt.Println("Error from FindCompanyByACN")
+			return nil, err
+		} else {
+			company = filterCompany(stub, company)
+			companyBytes, err1 := json.Marshal(&company)
+			if err1 != nil {
+				fmt.Println("Error marshalling the company")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the company")
+			return companyBytes, nil
+		}
+
+	} else if args[0] == "Search" {
+		fmt.Println("Searching persons or companies")
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting search query")
+		}
+		result, err := Search(stub, args[1])
+		if err != nil {
+			fmt.Println("Error from Search")
+			return nil, err
+		} else {
+			resultBytes, err1 := json.Marshal(&result)
+			if err1 != nil {
+				fmt.Println("Error marshalling the search result")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the search result")
+			return resultBytes, nil
+		}
+
 	} else if args[0] == "VerifyCompany" {
 		fmt.Println("Verifying the company")
-		company, err := VerifyCompany(stub, args[1])
+		report, err := VerifyCompany(stub, args[1])
 		if err != nil {
 			fmt.Println("Error from VerifyCompany")
 			return nil, err
 		} else {
-			companyBytes, err1 := json.Marshal(&company)
+			reportBytes, err1 := json.Marshal(&report)
 			if err1 != nil {
-				fmt.Println("Error marshalling the company")
+				fmt.Println("Error marshalling the verification report")
 				return nil, err1
 			}	
-			fmt.Println("All success, returning the company")
-			return companyBytes, nil		 
+			fmt.Println("All success, returning the verification report")
+			return reportBytes, nil		 
 		}
 
 	} else if args[0] == "VerifyPerson" {
 		fmt.Println("Verifying the person")
-		person, err := VerifyPerson(stub, args[1])
+		report, err := VerifyPerson(stub, args[1])
 		if err != nil {
 			fmt.Println("Error from VerifyPerson")
 			return nil, err
 		} else {
-			personBytes, err1 := json.Marshal(&person)
+			reportBytes, err1 := json.Marshal(&report)
 			if err1 != nil {
-				fmt.Println("Error marshalling the person")
+				fmt.Println("Error marshalling the verification report")
 				return nil, err1
 			}	
-			fmt.Println("All success, returning the person")
-			return personBytes, nil		 
+			fmt.Println("All success, returning the verification report")
+			return reportBytes, nil		 
 		}	
 
+
+	} else if args[0] == "GetEffectiveDateWindow" {
+		fmt.Println("Getting the effective date window")
+		window, err := GetEffectiveDateWindow(stub)
+		if err != nil {
+			fmt.Println("Error from GetEffectiveDateWindow")
+			return nil, err
+		} else {
+			windowBytes, err1 := json.Marshal(&window)
+			if err1 != nil {
+				fmt.Println("Error marshalling the effective date window")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the effective date window")
+			return windowBytes, nil
+		}
+	} else if args[0] == "GetVerificationPolicy" {
+		fmt.Println("Getting the verification policy")
+		if len(args) < 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting subject type")
+		}
+		policy, err := GetVerificationPolicy(stub, args[1])
+		if err != nil {
+			fmt.Println("Error from GetVerificationPolicy")
+			return nil, err
+		} else {
+			policyBytes, err1 := json.Marshal(&policy)
+			if err1 != nil {
+				fmt.Println("Error marshalling the verification policy")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the verification policy")
+			return policyBytes, nil
+		}
+
+
+	} else if args[0] == "GetVerificationHistory" {
+		fmt.Println("Getting the verification history")
+		if len(args) != 3 {
+			return nil, errors.New("Incorrect number of arguments. Expecting subject type and subject ID")
+		}
+		_, err := checkSubjectAccess(stub, args[1], args[2])
+		if err != nil {
+			return nil, err
+		}
+		history, err := GetVerificationHistory(stub, args[1], args[2])
+		if err != nil {
+			fmt.Println("Error from GetVerificationHistory")
+			return nil, err
+		} else {
+			historyBytes, err1 := json.Marshal(&history)
+			if err1 != nil {
+				fmt.Println("Error marshalling the verification history")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the verification history")
+			return historyBytes, nil
+		}
+
+
+	} else if args[0] == "GetAttestation" {
+		fmt.Println("Getting the attestation")
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting attestation ID")
+		}
+		attestation, err := GetAttestation(stub, args[1])
+		if err != nil {
+			fmt.Println("Error from GetAttestation")
+			return nil, err
+		} else {
+			attestationBytes, err1 := json.Marshal(&attestation)
+			if err1 != nil {
+				fmt.Println("Error marshalling the attestation")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the attestation")
+			return attestationBytes, nil
+		}
+
+	} else if args[0] == "CheckAttestation" {
+		fmt.Println("Getting the attestation check")
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting attestation")
+		}
+		check, err := CheckAttestation(stub, args[1])
+		if err != nil {
+			fmt.Println("Error from CheckAttestation")
+			return nil, err
+		} else {
+			checkBytes, err1 := json.Marshal(&check)
+			if err1 != nil {
+				fmt.Println("Error marshalling the attestation check")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the attestation check")
+			return checkBytes, nil
+		}
+
+	} else if args[0] == "GetAttestationKeys" {
+		fmt.Println("Getting the attestation keys")
+		keys, err := GetAttestationKeys(stub)
+		if err != nil {
+			fmt.Println("Error from GetAttestationKeys")
+			return nil, err
+		} else {
+			keysBytes, err1 := json.Marshal(&keys)
+			if err1 != nil {
+				fmt.Println("Error marshalling the attestation keys")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the attestation keys")
+			return keysBytes, nil
+		}
+
+
+	} else if args[0] == "GetCredential" {
+		fmt.Println("Getting the credential")
+		if len(args) < 3 {
+			return nil, errors.New("Incorrect number of arguments. Expecting subject type, subject ID and optional claim names")
+		}
+		selected, err := credentialClaimsArg(args)
+		if err != nil {
+			return nil, err
+		}
+		vc, err := GetCredential(stub, args[1], args[2], selected)
+		if err != nil {
+			fmt.Println("Error from GetCredential")
+			return nil, err
+		} else {
+			vcBytes, err1 := json.Marshal(&vc)
+			if err1 != nil {
+				fmt.Println("Error marshalling the credential")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the credential")
+			return vcBytes, nil
+		}
+
+	} else if args[0] == "GetStatusList" {
+		fmt.Println("Getting the status list")
+		if len(args) < 2 || len(args) > 3 {
+			return nil, errors.New("Incorrect number of arguments. Expecting subject type and optionally revocation or suspension")
+		}
+		vc, err := GetStatusList(stub, args[1], optionalArg(args, 2))
+		if err != nil {
+			fmt.Println("Error from GetStatusList")
+			return nil, err
+		} else {
+			vcBytes, err1 := json.Marshal(&vc)
+			if err1 != nil {
+				fmt.Println("Error marshalling the status list")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the status list")
+			return vcBytes, nil
+		}
+
+
+	} else if args[0] == "ResolveDID" {
+		fmt.Println("Resolving the DID")
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting DID")
+		}
+		resolution, err := ResolveDID(stub, args[1])
+		if err != nil {
+			fmt.Println("Error from ResolveDID")
+			return nil, err
+		} else {
+			resolutionBytes, err1 := json.Marshal(&resolution)
+			if err1 != nil {
+				fmt.Println("Error marshalling the DID resolution")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the DID resolution")
+			return resolutionBytes, nil
+		}
+
+
+	} else if args[0] == "GetErasure" {
+		fmt.Println("Getting the erasure of a person")
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting person ID")
+		}
+		erasure, err := GetErasure(stub, args[1])
+		if err != nil {
+			fmt.Println("Error from GetErasure")
+			return nil, err
+		} else {
+			erasureBytes, err1 := json.Marshal(&erasure)
+			if err1 != nil {
+				fmt.Println("Error marshalling the erasure")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the erasure")
+			return erasureBytes, nil
+		}
+
+	} else if args[0] == "GetUnreferencedPhotos" {
+		fmt.Println("Getting the unreferenced photos")
+		digests, err := GetUnreferencedPhotos(stub)
+		if err != nil {
+			fmt.Println("Error from GetUnreferencedPhotos")
+			return nil, err
+		} else {
+			digestsBytes, err1 := json.Marshal(&digests)
+			if err1 != nil {
+				fmt.Println("Error marshalling the unreferenced photos")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the unreferenced photos")
+			return digestsBytes, nil
+		}
+	} else if args[0] == "CheckPersonPhoto" {
+		fmt.Println("Checking the photo of a person")
+		if len(args) != 3 {
+			return nil, errors.New("Incorrect number of arguments. Expecting person ID and photo")
+		}
+		check, err := CheckPersonPhoto(stub, args[1], args[2])
+		if err != nil {
+			fmt.Println("Error from CheckPersonPhoto")
+			return nil, err
+		} else {
+			checkBytes, err1 := json.Marshal(&check)
+			if err1 != nil {
+				fmt.Println("Error marshalling the photo check")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the photo check")
+			return checkBytes, nil
+		}
+
+	} else if args[0] == "GetRelationship" {
+		fmt.Println("Getting a relationship")
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting relationship ID")
+		}
+		rel, err := GetRelationship(stub, args[1])
+		if err != nil {
+			fmt.Println("Error from GetRelationship")
+			return nil, err
+		} else {
+			relBytes, err1 := json.Marshal(&rel)
+			if err1 != nil {
+				fmt.Println("Error marshalling the relationship")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the relationship")
+			return relBytes, nil
+		}
+
+	} else if args[0] == "GetCompanyRelationships" {
+		fmt.Println("Getting the relationships of a company")
+		if len(args) < 2 || len(args) > 3 {
+			return nil, errors.New("Incorrect number of arguments. Expecting company ID and optionally active")
+		}
+		rels, err := GetCompanyRelationships(stub, args[1], activeOnlyArg(args, 2))
+		if err != nil {
+			fmt.Println("Error from GetCompanyRelationships")
+			return nil, err
+		} else {
+			relsBytes, err1 := json.Marshal(&rels)
+			if err1 != nil {
+				fmt.Println("Error marshalling the relationships")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the relationships")
+			return relsBytes, nil
+		}
+
+	} else if args[0] == "GetHolderRelationships" {
+		fmt.Println("Getting the relationships of a holder")
+		if len(args) < 3 || len(args) > 4 {
+			return nil, errors.New("Incorrect number of arguments. Expecting holder type, holder ID and optionally active")
+		}
+		rels, err := GetHolderRelationships(stub, args[1], args[2], activeOnlyArg(args, 3))
+		if err != nil {
+			fmt.Println("Error from GetHolderRelationships")
+			return nil, err
+		} else {
+			relsBytes, err1 := json.Marshal(&rels)
+			if err1 != nil {
+				fmt.Println("Error marshalling the relationships")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the relationships")
+			return relsBytes, nil
+		}
+
+	} else if args[0] == "GetBeneficialOwners" {
+		fmt.Println("Getting the beneficial owners of a company")
+		if len(args) < 2 || len(args) > 3 {
+			return nil, errors.New("Incorrect number of arguments. Expecting company ID and optionally a threshold percentage")
+		}
+		owners, err := GetBeneficialOwners(stub, args[1], optionalArg(args, 2))
+		if err != nil {
+			fmt.Println("Error from GetBeneficialOwners")
+			return nil, err
+		} else {
+			ownersBytes, err1 := json.Marshal(&owners)
+			if err1 != nil {
+				fmt.Println("Error marshalling the beneficial owners")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the beneficial owners")
+			return ownersBytes, nil
+		}
+
+	} else if args[0] == "GetCorporateTree" {
+		fmt.Println("Getting the corporate tree of a company")
+		if len(args) < 2 || len(args) > 4 {
+			return nil, errors.New("Incorrect number of arguments. Expecting company ID and optionally direction and depth")
+		}
+		tree, err := GetCorporateTree(stub, args[1], optionalArg(args, 2), optionalArg(args, 3))
+		if err != nil {
+			fmt.Println("Error from GetCorporateTree")
+			return nil, err
+		} else {
+			treeBytes, err1 := json.Marshal(&tree)
+			if err1 != nil {
+				fmt.Println("Error marshalling the corporate tree")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the corporate tree")
+			return treeBytes, nil
+		}
+
+	} else if args[0] == "GetClaimSalts" {
+		fmt.Println("Getting the claim salts")
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting person ID")
+		}
+		salts, err := GetClaimSalts(stub, args[1])
+		if err != nil {
+			fmt.Println("Error from GetClaimSalts")
+			return nil, err
+		} else {
+			saltsBytes, err1 := json.Marshal(&salts)
+			if err1 != nil {
+				fmt.Println("Error marshalling the claim salts")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the claim salts")
+			return saltsBytes, nil
+		}
+
+	} else if args[0] == "VerifyPersonClaims" {
+		fmt.Println("Verifying hashed person claims")
+		if len(args) != 3 {
+			return nil, errors.New("Incorrect number of arguments. Expecting person ID and claim hashes")
+		}
+		check, err := VerifyPersonClaims(stub, args[1], args[2])
+		if err != nil {
+			fmt.Println("Error from VerifyPersonClaims")
+			return nil, err
+		} else {
+			checkBytes, err1 := json.Marshal(&check)
+			if err1 != nil {
+				fmt.Println("Error marshalling the claims check")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the claims check")
+			return checkBytes, nil
+		}
+
+
+	} else if args[0] == "IsPersonOlderThan" {
+		fmt.Println("Checking the age of a person")
+		if len(args) != 3 {
+			return nil, errors.New("Incorrect number of arguments. Expecting person ID and years")
+		}
+		predicate, err := IsPersonOlderThan(stub, args[1], args[2])
+		if err != nil {
+			fmt.Println("Error from IsPersonOlderThan")
+			return nil, err
+		} else {
+			predicateBytes, err1 := json.Marshal(&predicate)
+			if err1 != nil {
+				fmt.Println("Error marshalling the age predicate")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the age predicate")
+			return predicateBytes, nil
+		}
+
+
+	} else if args[0] == "GetConsent" {
+		fmt.Println("Getting the consent")
+		if len(args) != 3 {
+			return nil, errors.New("Incorrect number of arguments. Expecting person ID and relying party")
+		}
+		err := checkConsentReader(stub, args[1], args[2])
+		if err != nil {
+			return nil, err
+		}
+		consent, found, err := GetConsent(stub, args[1], args[2])
+		if err == nil && !found {
+			err = errors.New("No consent of " + args[1] + " for " + args[2])
+		}
+		if err != nil {
+			fmt.Println("Error from GetConsent")
+			return nil, err
+		} else {
+			consentBytes, err1 := json.Marshal(&consent)
+			if err1 != nil {
+				fmt.Println("Error marshalling the consent")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the consent")
+			return consentBytes, nil
+		}
+
+	} else if args[0] == "GetConsentLog" {
+		fmt.Println("Getting the consent log")
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting person ID")
+		}
+		_, err := checkSubjectAccess(stub, ownerTypePerson, args[1])
+		if err != nil {
+			return nil, err
+		}
+		log, err := GetConsentLog(stub, args[1])
+		if err != nil {
+			fmt.Println("Error from GetConsentLog")
+			return nil, err
+		} else {
+			logBytes, err1 := json.Marshal(&log)
+			if err1 != nil {
+				fmt.Println("Error marshalling the consent log")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the consent log")
+			return logBytes, nil
+		}
+
 /************* ID-Man **************************/
 
 	} else {
 		fmt.Println("Generic Query call")
+		if isPrivateKey(args[0]) {
+			return nil, errors.New("Key " + args[0] + " can't be queried")
+		}
 		bytes, err := stub.GetState(args[0])
 
 		if err != nil {
@@ -1337,6 +2265,31 @@ func (t *SimpleChaincode) Query(stub *shim.ChaincodeStub, function string, args
 			return nil, errors.New("Some Error happened")
 		}
 
+		// Person and company records show only what the caller may see
+		if strings.HasPrefix(args[0], personPrefix) && bytes != nil {
+			var person Person
+			err = json.Unmarshal(bytes, &person)
+			if err != nil {
+				fmt.Println("Error unmarshalling person " + args[0])
+				return nil, errors.New("Error unmarshalling person " + args[0])
+			}
+			person, err = filterPersonByConsent(stub, person)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(&person)
+		}
+		if strings.HasPrefix(args[0], companyPrefix) && bytes != nil {
+			var company Company
+			err = json.Unmarshal(bytes, &company)
+			if err != nil {
+				fmt.Println("Error unmarshalling company " + args[0])
+				return nil, errors.New("Error unmarshalling company " + args[0])
+			}
+			company = filterCompany(stub, company)
+			return json.Marshal(&company)
+		}
+
 		fmt.Println("All success, returning from generic")
 		return bytes, nil		
 	} 
@@ -1363,6 +2316,102 @@ func (t *SimpleChaincode) Invoke(stub *shim.ChaincodeStub, function string, args
 	} else if function == "registerCompany" {
         //Create a Company
         return t.registerCompany(stub, args)
+
+	} else if _, ok := personTransitions[function]; ok {
+		fmt.Println("Firing " + function)
+		return t.changePersonStatus(stub, function, args)
+
+	} else if function == "erasePerson" {
+		fmt.Println("Firing erasePerson")
+		return t.erasePerson(stub, args)
+
+	} else if _, ok := companyTransitions[function]; ok {
+		fmt.Println("Firing " + function)
+		return t.changeCompanyStatus(stub, function, args)
+
+	} else if function == "setEffectiveDateWindow" {
+		fmt.Println("Firing setEffectiveDateWindow")
+		return t.setEffectiveDateWindow(stub, args)
+
+	} else if function == "setVerificationPolicy" {
+		fmt.Println("Firing setVerificationPolicy")
+		return t.setVerificationPolicy(stub, args)
+
+	} else if function == "verifyPerson" {
+		fmt.Println("Firing verifyPerson")
+		return t.verifyPerson(stub, args)
+
+	} else if function == "verifyCompany" {
+		fmt.Println("Firing verifyCompany")
+		return t.verifyCompany(stub, args)
+
+	} else if function == "setAttestationKey" {
+		fmt.Println("Firing setAttestationKey")
+		return t.setAttestationKey(stub, args)
+
+	} else if function == "registerDID" {
+		fmt.Println("Firing registerDID")
+		return t.registerDID(stub, args)
+
+	} else if function == "rotateDIDKey" {
+		fmt.Println("Firing rotateDIDKey")
+		return t.rotateDIDKey(stub, args)
+
+	} else if function == "deactivateDID" {
+		fmt.Println("Firing deactivateDID")
+		return t.deactivateDID(stub, args)
+
+	} else if function == "registerRelationship" {
+		fmt.Println("Firing registerRelationship")
+		return t.registerRelationship(stub, args)
+
+	} else if function == "endRelationship" {
+		fmt.Println("Firing endRelationship")
+		return t.endRelationship(stub, args)
+
+	} else if function == "registerCompanyOwnership" {
+		fmt.Println("Firing registerCompanyOwnership")
+		return t.registerCompanyOwnership(stub, args)
+
+	} else if function == "mergePersons" {
+		fmt.Println("Firing mergePersons")
+		return t.mergePersons(stub, args)
+
+	} else if function == "mergeCompanies" {
+		fmt.Println("Firing mergeCompanies")
+		return t.mergeCompanies(stub, args)
+
+	} else if function == "registerPersonsBatch" {
+		fmt.Println("Firing registerPersonsBatch")
+		return t.registerPersonsBatch(stub, args)
+
+	} else if function == "registerCompaniesBatch" {
+		fmt.Println("Firing registerCompaniesBatch")
+		return t.registerCompaniesBatch(stub, args)
+
+	} else if function == "addUrlLink" {
+		fmt.Println("Firing addUrlLink")
+		return t.addUrlLink(stub, args)
+
+	} else if function == "removeUrlLink" {
+		fmt.Println("Firing removeUrlLink")
+		return t.removeUrlLink(stub, args)
+
+	} else if function == "offloadPersonPhoto" {
+		fmt.Println("Firing offloadPersonPhoto")
+		return t.offloadPersonPhoto(stub, args)
+
+	} else if function == "bindEnrollment" {
+		fmt.Println("Firing bindEnrollment")
+		return t.bindEnrollment(stub, args)
+
+	} else if function == "grantConsent" {
+		fmt.Println("Firing grantConsent")
+		return t.grantConsent(stub, args)
+
+	} else if function == "revokeConsent" {
+		fmt.Println("Firing revokeConsent")
+		return t.revokeConsent(stub, args)
 /************* ID-Man **************************/      
 	} else if function == "transferPaper" {
 		fmt.Println("Firing cretransferPaperateAccounts")
@@ -0,0 +1,388 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: W3C Verifiable Credential export of Person and Company records
+
+GetCredential renders a registered person or company as a VC JSON-LD document
+with two StatusList2021 entries. The revocation list has the bit of every
+subject that is gone for good set, revoked, deceased, deregistered, erased or
+merged; the suspension list that of every subject that may become active
+again, pending, suspended or sanctioned. GetStatusList returns the status list
+credential for either purpose.
+
+The issuer of every credential is the registry, whose attestation key signs
+it. When an attestation key is set the credential carries a detached JWS over
+its json encoding (without the proof), signed with that key. The payload is
+not RDF canonicalised, so check it against GetAttestationKeys rather than with
+a generic JSON-LD signature suite.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Append-only lists giving every registered subject a fixed status list index
+var statusListKeysPrefix = "StatusListKeys:"
+
+// Status lists are padded to at least this many entries, as StatusList2021 asks
+var minStatusListLength = 131072
+
+// Purposes of the status lists
+const (
+	statusPurposeRevocation = "revocation"
+	statusPurposeSuspension = "suspension"
+)
+
+// Statuses a subject can return to active from, set on the suspension list.
+// Every other status but active is set on the revocation list.
+var suspendedStatuses = map[string]bool{statusPending: true, statusSuspended: true, statusSanctioned: true}
+
+// The registry issues every credential and signs it with its attestation key
+var registryIssuer = CredentialIssuer{ID: "urn:idman:registry", Name: "ID-Man registry"}
+
+var credentialContexts = []string{
+	"https://www.w3.org/2018/credentials/v1",
+	"https://w3id.org/vc/status-list/2021/v1",
+}
+
+// Claims put in a credential when the caller doesn't select any
+var defaultPersonClaims = []string{"firstName", "lastName", "birthDate", "address", "city", "postcode", "state"}
+var defaultCompanyClaims = []string{"name", "acn", "abn", "regDate", "regState", "address", "city", "postcode", "state"}
+
+type CredentialIssuer struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type CredentialStatus struct {
+	ID                   string `json:"id"`
+	Type                 string `json:"type"`
+	StatusPurpose        string `json:"statusPurpose"`
+	StatusListIndex      string `json:"statusListIndex"`
+	StatusListCredential string `json:"statusListCredential"`
+}
+
+type CredentialProof struct {
+	Type               string `json:"type"`
+	Created            string `json:"created"`
+	ProofPurpose       string `json:"proofPurpose"`
+	VerificationMethod string `json:"verificationMethod"`
+	JWS                string `json:"jws"`
+}
+
+// VerifiableCredential is a W3C VC data model 1.1 credential
+type VerifiableCredential struct {
+	Context           []string               `json:"@context"`
+	ID                string                 `json:"id"`
+	Type              []string               `json:"type"`
+	Issuer            CredentialIssuer       `json:"issuer"`
+	IssuanceDate      string                 `json:"issuanceDate"`
+	CredentialSubject map[string]interface{} `json:"credentialSubject"`
+	CredentialStatus  []CredentialStatus     `json:"credentialStatus,omitempty"`
+	Proof             *CredentialProof       `json:"proof,omitempty"`
+}
+
+func subjectURN(subjectType string, subjectID string) string {
+	return "urn:idman:" + subjectType + ":" + subjectID
+}
+
+func statusListURN(subjectType string, purpose string) string {
+	if purpose == statusPurposeRevocation {
+		return "urn:idman:status-list:" + subjectType
+	}
+	return "urn:idman:status-list:" + subjectType + ":" + purpose
+}
+
+// statusBit tells whether the bit of a subject with the given status is set
+// on the status list for a purpose
+func statusBit(status string, purpose string) bool {
+	if status == statusActive {
+		return false
+	}
+	if purpose == statusPurposeSuspension {
+		return suspendedStatuses[status]
+	}
+	return !suspendedStatuses[status]
+}
+
+// addToStatusList gives a newly registered subject its status list index
+func addToStatusList(stub *shim.ChaincodeStub, subjectType string, subjectID string) error {
+	return appendKey(stub, statusListKeysPrefix+subjectType, subjectID)
+}
+
+// indexStatusLists gives records registered before status lists existed an
+// index. It is run from Init.
+func indexStatusLists(stub *shim.ChaincodeStub) error {
+	for subjectType, keysID := range map[string]string{ownerTypePerson: personKeysID, ownerTypeCompany: companyKeysID} {
+		keys, err := getKeyList(stub, keysID)
+		if err != nil {
+			return err
+		}
+		prefix := personPrefix
+		if subjectType == ownerTypeCompany {
+			prefix = companyPrefix
+		}
+		for _, key := range keys {
+			err = addToStatusList(stub, subjectType, strings.TrimPrefix(key, prefix))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func statusListIndex(stub *shim.ChaincodeStub, subjectType string, subjectID string) (int, error) {
+	ids, err := getKeyList(stub, statusListKeysPrefix+subjectType)
+	if err != nil {
+		return 0, err
+	}
+	for i, id := range ids {
+		if id == subjectID {
+			return i, nil
+		}
+	}
+	return 0, errors.New(subjectType + " " + subjectID + " has no status list entry")
+}
+
+// selectClaims picks the requested claims from a record. Unknown claim names
+// are an error rather than silently dropped.
+func selectClaims(values map[string]string, selected []string) (map[string]interface{}, error) {
+	claims := map[string]interface{}{}
+	for _, field := range selected {
+		value, ok := values[field]
+		if !ok {
+			return nil, errors.New("Unknown claim " + field)
+		}
+		if value != "" {
+			claims[field] = value
+		}
+	}
+	return claims, nil
+}
+
+// GetCredential renders a registered, active person or company as a
+// Verifiable Credential holding the selected claims. A person's claims are
+// limited to the fields the caller may see, see filterPersonByConsent.
+func GetCredential(stub *shim.ChaincodeStub, subjectType string, subjectID string, selected []string) (VerifiableCredential, error) {
+	var vc VerifiableCredential
+	var values = map[string]string{}
+	var status, credentialType string
+	var registerDate Timestamp
+
+	if subjectType == ownerTypePerson {
+		person, err := GetPerson(subjectID, stub)
+		if err != nil {
+			return vc, err
+		}
+		// Claims are limited to what the caller has consent for
+		visible, err := filterPersonByConsent(stub, person)
+		if err != nil {
+			return vc, err
+		}
+		for field, value := range personVerifyFields {
+			values[field] = value(visible)
+		}
+		if len(selected) == 0 {
+			selected = defaultPersonClaims
+		}
+		registerDate, status = person.RegisterDate, person.Status
+		credentialType = "PersonCredential"
+	} else if subjectType == ownerTypeCompany {
+		company, err := GetCompany(subjectID, stub)
+		if err != nil {
+			return vc, err
+		}
+		for field, value := range companyVerifyFields {
+			values[field] = value(company)
+		}
+		if len(selected) == 0 {
+			selected = defaultCompanyClaims
+		}
+		registerDate, status = company.RegisterDate, company.Status
+		credentialType = "CompanyCredential"
+	} else {
+		return vc, errors.New("Unknown subject type " + subjectType + ", expecting person or company")
+	}
+
+	if effectiveStatus(status) != statusActive {
+		return vc, errors.New("Can't issue a credential for a " + subjectType + " that is " + status)
+	}
+	issued, err := registerDate.Time()
+	if err != nil {
+		return vc, errors.New(subjectType + " " + subjectID + " has no usable register date: " + err.Error())
+	}
+
+	claims, err := selectClaims(values, selected)
+	if err != nil {
+		return vc, err
+	}
+	claims["id"] = subjectURN(subjectType, subjectID)
+
+	index, err := statusListIndex(stub, subjectType, subjectID)
+	if err != nil {
+		return vc, err
+	}
+
+	vc = VerifiableCredential{
+		Context:           credentialContexts,
+		ID:                "urn:idman:credential:" + subjectType + ":" + subjectID,
+		Type:              []string{"VerifiableCredential", credentialType},
+		Issuer:            registryIssuer,
+		IssuanceDate:      issued.Format(time.RFC3339),
+		CredentialSubject: claims,
+	}
+	for _, purpose := range []string{statusPurposeRevocation, statusPurposeSuspension} {
+		vc.CredentialStatus = append(vc.CredentialStatus, CredentialStatus{
+			ID:                   statusListURN(subjectType, purpose) + "#" + strconv.Itoa(index),
+			Type:                 "StatusList2021Entry",
+			StatusPurpose:        purpose,
+			StatusListIndex:      strconv.Itoa(index),
+			StatusListCredential: statusListURN(subjectType, purpose),
+		})
+	}
+
+	err = signCredential(stub, &vc)
+	if err != nil {
+		return vc, err
+	}
+	return vc, nil
+}
+
+// GetStatusList returns the StatusList2021 credential for persons or
+// companies and a purpose, revocation when none is given
+func GetStatusList(stub *shim.ChaincodeStub, subjectType string, purpose string) (VerifiableCredential, error) {
+	var vc VerifiableCredential
+
+	if subjectType != ownerTypePerson && subjectType != ownerTypeCompany {
+		return vc, errors.New("Unknown subject type " + subjectType + ", expecting person or company")
+	}
+	if purpose == "" {
+		purpose = statusPurposeRevocation
+	}
+	if purpose != statusPurposeRevocation && purpose != statusPurposeSuspension {
+		return vc, errors.New("Unknown status purpose " + purpose + ", expecting revocation or suspension")
+	}
+
+	ids, err := getKeyList(stub, statusListKeysPrefix+subjectType)
+	if err != nil {
+		return vc, err
+	}
+
+	length := minStatusListLength
+	if len(ids) > length {
+		length = len(ids)
+	}
+	bits := make([]byte, (length+7)/8)
+	for i, id := range ids {
+		if statusBit(subjectStatus(stub, subjectType, id), purpose) {
+			bits[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, err = zw.Write(bits)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		fmt.Println("Error compressing status list")
+		return vc, errors.New("Error building status list")
+	}
+
+	vc = VerifiableCredential{
+		Context:      credentialContexts,
+		ID:           statusListURN(subjectType, purpose),
+		Type:         []string{"VerifiableCredential", "StatusList2021Credential"},
+		Issuer:       registryIssuer,
+		IssuanceDate: time.Unix(0, 0).UTC().Format(time.RFC3339),
+		CredentialSubject: map[string]interface{}{
+			"id":            statusListURN(subjectType, purpose) + "#list",
+			"type":          "StatusList2021",
+			"statusPurpose": purpose,
+			"encodedList":   base64.RawURLEncoding.EncodeToString(compressed.Bytes()),
+		},
+	}
+	if now, err := txTime(stub); err == nil {
+		vc.IssuanceDate = now.Format(time.RFC3339)
+	}
+
+	err = signCredential(stub, &vc)
+	if err != nil {
+		return vc, err
+	}
+	return vc, nil
+}
+
+// signCredential adds a detached JWS proof made with the attestation key. The
+// credential is left unsigned when no attestation key has been set.
+func signCredential(stub *shim.ChaincodeStub, vc *VerifiableCredential) error {
+	keyID, private, err := getAttestationSigner(stub)
+	if err != nil {
+		return err
+	}
+	if keyID == "" {
+		fmt.Println("No attestation key set, credential is not signed")
+		return nil
+	}
+
+	vc.Proof = nil
+	payload, err := json.Marshal(vc)
+	if err != nil {
+		fmt.Println("Error marshalling credential")
+		return errors.New("Error signing credential")
+	}
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","b64":false,"crit":["b64"]}`))
+	signingInput := append([]byte(header+"."), payload...)
+	signature := ed25519.Sign(private, signingInput)
+
+	vc.Proof = &CredentialProof{
+		Type:               "Ed25519Signature2018",
+		Created:            vc.IssuanceDate,
+		ProofPurpose:       "assertionMethod",
+		VerificationMethod: "urn:idman:attestation-key:" + keyID,
+		JWS:                header + ".." + base64.RawURLEncoding.EncodeToString(signature),
+	}
+	return nil
+}
+
+// credentialClaimsArg reads the optional json array of claim names passed to
+// the GetCredential query
+func credentialClaimsArg(args []string) ([]string, error) {
+	var selected []string
+	if len(args) < 4 || args[3] == "" {
+		return selected, nil
+	}
+	err := json.Unmarshal([]byte(args[3]), &selected)
+	if err != nil {
+		return nil, errors.New("Expecting a json array of claim names")
+	}
+	return selected, nil
+}
@@ -0,0 +1,138 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: dates and timestamps held on Person, Company and CP records
+
+BirthDate, RegDate, RegisterDate and IssueDate are Timestamps. They are read
+from epoch milliseconds, as a json string or number of at least 9 digits, an
+ISO-8601 timestamp or a plain yyyy-mm-dd date, and kept in a canonical form: a plain date stays
+yyyy-mm-dd and anything with a time becomes an RFC3339 UTC timestamp with
+milliseconds. Stored values that can't be parsed, from before dates were
+checked, are kept as they are so the record can still be read; registration
+rejects them, and rejects dates in the future. RegisterDate and IssueDate are
+set from the transaction, see effective_date.go.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/IBM-Blockchain/cp-chaincode-v2/hyperledger/idcheck"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Layouts of the canonical forms of a Timestamp
+const (
+	dateLayout      = idcheck.DateLayout
+	timestampLayout = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// How far ahead of the transaction time a date may be before it counts as
+// in the future
+var maxClockSkew = idcheck.MaxClockSkew
+
+// Timestamp is a date or a date and time in canonical form
+type Timestamp string
+
+// parseDate reads a date held as epoch milliseconds (as IssueDate is, negative
+// before 1970), an ISO-8601 timestamp or a plain yyyy-mm-dd date, see
+// idcheck.ParseDate. Dates are returned in UTC.
+func parseDate(s string) (time.Time, error) {
+	t, _, err := idcheck.ParseDate(s)
+	return t, err
+}
+
+// canonicalTimestamp parses a date and returns its canonical form
+func canonicalTimestamp(s string) (Timestamp, error) {
+	t, plainDate, err := idcheck.ParseDate(s)
+	if err != nil {
+		return Timestamp(s), err
+	}
+	if plainDate {
+		return Timestamp(t.Format(dateLayout)), nil
+	}
+	return Timestamp(t.Format(timestampLayout)), nil
+}
+
+// UnmarshalJSON reads a Timestamp given as a string or as epoch milliseconds
+// in a number. A value that can't be parsed is kept as it is.
+func (ts *Timestamp) UnmarshalJSON(data []byte) error {
+	var s string
+	if len(data) > 0 && data[0] != '"' && string(data) != "null" {
+		var n json.Number
+		err := json.Unmarshal(data, &n)
+		if err != nil {
+			return err
+		}
+		s = n.String()
+	} else if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	*ts, _ = canonicalTimestamp(s)
+	return nil
+}
+
+// Time returns the time a Timestamp stands for, in UTC
+func (ts Timestamp) Time() (time.Time, error) {
+	return parseDate(string(ts))
+}
+
+// checkTimestamp rejects a date that can't be parsed or is later than now.
+// A blank date is accepted.
+func checkTimestamp(field string, ts Timestamp, now time.Time) error {
+	if ts == "" {
+		return nil
+	}
+	t, err := ts.Time()
+	if err != nil {
+		return errors.New("Invalid " + field + " " + string(ts) + ", expecting epoch milliseconds, ISO-8601 or yyyy-mm-dd")
+	}
+	if t.After(now.Add(maxClockSkew)) {
+		return errors.New(field + " " + string(ts) + " is in the future")
+	}
+	return nil
+}
+
+// preparePersonDates checks the dates of a person being registered and sets
+// its register date
+func preparePersonDates(stub *shim.ChaincodeStub, person *Person) error {
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	err = checkTimestamp("birthDate", person.BirthDate, now)
+	if err != nil {
+		return err
+	}
+	return stampTxTime(stub, "registerDate", &person.RegisterDate, &person.EffectiveDate)
+}
+
+// prepareCompanyDates checks the dates of a company being registered and sets
+// its register date
+func prepareCompanyDates(stub *shim.ChaincodeStub, company *Company) error {
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	err = checkTimestamp("regDate", company.RegDate, now)
+	if err != nil {
+		return err
+	}
+	return stampTxTime(stub, "registerDate", &company.RegisterDate, &company.EffectiveDate)
+}
@@ -0,0 +1,100 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCanonicalTimestamp(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Timestamp
+		wantErr bool
+	}{
+		{in: "1980-01-01", want: "1980-01-01"},
+		{in: "1500000000000", want: "2017-07-14T02:40:00.000Z"},
+		{in: "100000000", want: "1970-01-02T03:46:40.000Z"},
+		{in: "-315619200000", want: "1960-01-01T00:00:00.000Z"},
+		{in: "2016-03-04T05:06:07+02:00", want: "2016-03-04T03:06:07.000Z"},
+		{in: "2016-03-04T05:06:07.250Z", want: "2016-03-04T05:06:07.250Z"},
+		{in: "2016-03-04T05:06:07", want: "2016-03-04T05:06:07.000Z"},
+		// Short numbers are ambiguous: a basic ISO-8601 date, a year or a
+		// time close to 1970 read as epoch milliseconds
+		{in: "19800101", wantErr: true},
+		{in: "1980", wantErr: true},
+		{in: "0", wantErr: true},
+		{in: "-86400000", wantErr: true},
+		{in: "99999999999999999999", wantErr: true},
+		{in: "04/03/2016", wantErr: true},
+		{in: "1980-13-01", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := canonicalTimestamp(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("canonicalTimestamp(%q) = %q, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("canonicalTimestamp(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestTimestampUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Timestamp
+	}{
+		{`1500000000000`, "2017-07-14T02:40:00.000Z"},
+		{`"1500000000000"`, "2017-07-14T02:40:00.000Z"},
+		{`"1980-01-01"`, "1980-01-01"},
+		{`"not a date"`, "not a date"},
+		{`19800101`, "19800101"},
+		{`null`, ""},
+	}
+	for _, tt := range tests {
+		var ts Timestamp
+		if err := json.Unmarshal([]byte(tt.in), &ts); err != nil || ts != tt.want {
+			t.Errorf("Unmarshal(%s) = %q, %v, want %q", tt.in, ts, err, tt.want)
+		}
+	}
+}
+
+func TestCheckTimestamp(t *testing.T) {
+	now := time.Date(2017, 7, 14, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		ts      Timestamp
+		wantErr bool
+	}{
+		{"", false},
+		{"1980-01-01", false},
+		{"2017-07-14T00:04:00.000Z", false},
+		{"2017-07-14T00:06:00.000Z", true},
+		{"2017-07-15", true},
+		{"19800101", true},
+	}
+	for _, tt := range tests {
+		err := checkTimestamp("birthDate", tt.ts, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkTimestamp(%q) = %v, want error %v", tt.ts, err, tt.wantErr)
+		}
+	}
+}
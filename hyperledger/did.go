@@ -0,0 +1,412 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: decentralised identifiers for registered persons and companies
+
+Every registered entity has the DID did:idman:<person|company>:<id>. The
+entity, its registrator or an admin registers an ed25519 public key with
+registerDID. Key rotation and deactivation must be signed with the current
+key, so only the holder of that key can change the DID. Service endpoints are
+taken from the UrlLinks of the registry record when the DID is resolved.
+*/
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var didMethodPrefix = "did:idman:"
+var didPrefix = "didrec:"
+
+// DIDKey is one public key registered for a DID
+type DIDKey struct {
+	ID        string `json:"id"`
+	PublicKey string `json:"publicKey"` // base64
+	Added     string `json:"added"`
+	Revoked   string `json:"revoked,omitempty"`
+}
+
+// DIDRecord is what the ledger keeps for a DID. The DID document is built from
+// it when the DID is resolved.
+type DIDRecord struct {
+	DID         string   `json:"did"`
+	SubjectType string   `json:"subjectType"`
+	SubjectID   string   `json:"subjectId"`
+	Keys        []DIDKey `json:"keys"`
+	Created     string   `json:"created"`
+	Updated     string   `json:"updated"`
+	Deactivated bool     `json:"deactivated"`
+}
+
+type DIDVerificationMethod struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	Controller      string `json:"controller"`
+	PublicKeyBase58 string `json:"publicKeyBase58"`
+}
+
+type DIDService struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	ServiceEndpoint string `json:"serviceEndpoint"`
+}
+
+// DIDDocument is a W3C DID Core document
+type DIDDocument struct {
+	Context            []string                `json:"@context"`
+	ID                 string                  `json:"id"`
+	Controller         string                  `json:"controller,omitempty"`
+	VerificationMethod []DIDVerificationMethod `json:"verificationMethod,omitempty"`
+	Authentication     []string                `json:"authentication,omitempty"`
+	AssertionMethod    []string                `json:"assertionMethod,omitempty"`
+	Service            []DIDService            `json:"service,omitempty"`
+}
+
+type DIDDocumentMetadata struct {
+	Created     string `json:"created"`
+	Updated     string `json:"updated"`
+	Deactivated bool   `json:"deactivated"`
+	VersionID   string `json:"versionId"`
+}
+
+// DIDResolution is the result of ResolveDID
+type DIDResolution struct {
+	DIDDocument         DIDDocument         `json:"didDocument"`
+	DIDDocumentMetadata DIDDocumentMetadata `json:"didDocumentMetadata"`
+}
+
+func didFor(subjectType string, subjectID string) string {
+	return didMethodPrefix + subjectType + ":" + subjectID
+}
+
+// parseDID splits a did:idman DID into subject type and ID
+func parseDID(did string) (string, string, error) {
+	rest := strings.TrimPrefix(did, didMethodPrefix)
+	parts := strings.SplitN(rest, ":", 2)
+	if rest == did || len(parts) != 2 || parts[1] == "" || (parts[0] != ownerTypePerson && parts[0] != ownerTypeCompany) {
+		return "", "", errors.New("Invalid DID " + did + ", expecting " + didMethodPrefix + "<person|company>:<id>")
+	}
+	return parts[0], parts[1], nil
+}
+
+func decodeDIDPublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("Public key must be a 32 byte ed25519 key, base64 encoded")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+func getDIDRecord(stub *shim.ChaincodeStub, did string) (DIDRecord, error) {
+	var record DIDRecord
+
+	recordBytes, err := stub.GetState(didPrefix + did)
+	if err != nil || recordBytes == nil {
+		return record, errors.New("DID " + did + " not found")
+	}
+	err = json.Unmarshal(recordBytes, &record)
+	if err != nil {
+		fmt.Println("Error unmarshalling DID " + did)
+		return record, errors.New("Error unmarshalling DID " + did)
+	}
+	return record, nil
+}
+
+func putDIDRecord(stub *shim.ChaincodeStub, record DIDRecord) error {
+	recordBytes, err := json.Marshal(&record)
+	if err != nil {
+		fmt.Println("Error marshalling DID " + record.DID)
+		return errors.New("Error marshalling DID " + record.DID)
+	}
+	err = stub.PutState(didPrefix+record.DID, recordBytes)
+	if err != nil {
+		fmt.Println("Error writing DID " + record.DID)
+		return errors.New("Error writing DID " + record.DID)
+	}
+	return nil
+}
+
+// currentKey returns the key that may sign changes to a DID
+func (r DIDRecord) currentKey() (DIDKey, error) {
+	for i := len(r.Keys) - 1; i >= 0; i-- {
+		if r.Keys[i].Revoked == "" {
+			return r.Keys[i], nil
+		}
+	}
+	return DIDKey{}, errors.New("DID " + r.DID + " has no current key")
+}
+
+// checkDIDSignature checks that message was signed with the current key of
+// the DID
+func checkDIDSignature(record DIDRecord, message string, sSignature string) error {
+	key, err := record.currentKey()
+	if err != nil {
+		return err
+	}
+	public, err := decodeDIDPublicKey(key.PublicKey)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(sSignature)
+	if err != nil || !ed25519.Verify(public, []byte(message), signature) {
+		return errors.New("Signature is not from the current key of " + record.DID)
+	}
+	return nil
+}
+
+func (t *SimpleChaincode) registerDID(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	/*		0					1			2
+			"person|company"	"subjectId"		base64 ed25519 public key
+	*/
+	if len(args) != 3 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting subject type, subject ID and public key")
+	}
+
+	status := subjectStatus(stub, args[0], args[1])
+	if status == "" {
+		return nil, errors.New("No registered " + args[0] + " " + args[1])
+	}
+	if status != statusActive {
+		return nil, errors.New("Can't register a DID for a " + args[0] + " that is " + status)
+	}
+	// Whoever registers the first key controls the DID
+	_, err := checkSubjectAccess(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decodeDIDPublicKey(args[2]); err != nil {
+		return nil, err
+	}
+
+	did := didFor(args[0], args[1])
+	if _, err := getDIDRecord(stub, did); err == nil {
+		return nil, errors.New("DID " + did + " is already registered")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	created := now.Format(time.RFC3339)
+
+	record := DIDRecord{
+		DID:         did,
+		SubjectType: args[0],
+		SubjectID:   args[1],
+		Keys:        []DIDKey{{ID: did + "#key-1", PublicKey: args[2], Added: created}},
+		Created:     created,
+		Updated:     created,
+	}
+	err = putDIDRecord(stub, record)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Registered DID " + did)
+	return []byte(did), nil
+}
+
+func (t *SimpleChaincode) rotateDIDKey(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	/*		0		1							2
+			"did"	base64 new public key		base64 signature by the current key over "rotate:<did>:<new public key>"
+	*/
+	if len(args) != 3 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting DID, new public key and signature")
+	}
+
+	record, err := getDIDRecord(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if record.Deactivated {
+		return nil, errors.New("DID " + record.DID + " is deactivated")
+	}
+	if _, err := decodeDIDPublicKey(args[1]); err != nil {
+		return nil, err
+	}
+	err = checkDIDSignature(record, "rotate:"+record.DID+":"+args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	updated := now.Format(time.RFC3339)
+
+	for i := range record.Keys {
+		if record.Keys[i].Revoked == "" {
+			record.Keys[i].Revoked = updated
+		}
+	}
+	record.Keys = append(record.Keys, DIDKey{ID: record.DID + "#key-" + strconv.Itoa(len(record.Keys)+1), PublicKey: args[1], Added: updated})
+	record.Updated = updated
+
+	err = putDIDRecord(stub, record)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Rotated key of DID " + record.DID)
+	return nil, nil
+}
+
+func (t *SimpleChaincode) deactivateDID(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	/*		0		1
+			"did"	base64 signature by the current key over "deactivate:<did>"
+	*/
+	if len(args) != 2 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting DID and signature")
+	}
+
+	record, err := getDIDRecord(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if record.Deactivated {
+		return nil, errors.New("DID " + record.DID + " is already deactivated")
+	}
+	err = checkDIDSignature(record, "deactivate:"+record.DID, args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	record.Deactivated = true
+	record.Updated = now.Format(time.RFC3339)
+
+	err = putDIDRecord(stub, record)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Deactivated DID " + record.DID)
+	return nil, nil
+}
+
+// ResolveDID builds the DID document of a did:idman DID. A deactivated DID
+// resolves to a bare document with deactivated set in the metadata.
+func ResolveDID(stub *shim.ChaincodeStub, did string) (DIDResolution, error) {
+	var resolution DIDResolution
+
+	if _, _, err := parseDID(did); err != nil {
+		return resolution, err
+	}
+	record, err := getDIDRecord(stub, did)
+	if err != nil {
+		return resolution, err
+	}
+
+	resolution.DIDDocumentMetadata = DIDDocumentMetadata{
+		Created:     record.Created,
+		Updated:     record.Updated,
+		Deactivated: record.Deactivated,
+		VersionID:   strconv.Itoa(len(record.Keys)),
+	}
+	doc := DIDDocument{
+		Context: []string{"https://www.w3.org/ns/did/v1", "https://w3id.org/security/suites/ed25519-2018/v1"},
+		ID:      did,
+	}
+	if record.Deactivated {
+		resolution.DIDDocument = doc
+		return resolution, nil
+	}
+
+	doc.Controller = did
+	key, err := record.currentKey()
+	if err != nil {
+		return resolution, err
+	}
+	public, err := decodeDIDPublicKey(key.PublicKey)
+	if err != nil {
+		return resolution, err
+	}
+	doc.VerificationMethod = []DIDVerificationMethod{{ID: key.ID, Type: "Ed25519VerificationKey2018", Controller: did, PublicKeyBase58: base58Encode(public)}}
+	doc.Authentication = []string{key.ID}
+	doc.AssertionMethod = []string{key.ID}
+
+	var links []UrlLink
+	if record.SubjectType == ownerTypePerson {
+		// The links of a person need consent like the rest of the record
+		person, err := GetPerson(record.SubjectID, stub)
+		if err == nil {
+			person, err = filterPersonByConsent(stub, person)
+		}
+		if err == nil {
+			links = person.UrlLinks
+		}
+	} else {
+		company, err := GetCompany(record.SubjectID, stub)
+		if err == nil {
+			links = company.UrlLinks
+		}
+	}
+	for i, link := range links {
+		serviceType := link.UrlType
+		if serviceType == "" {
+			serviceType = "LinkedDomains"
+		}
+		doc.Service = append(doc.Service, DIDService{ID: did + "#link-" + strconv.Itoa(i+1), Type: serviceType, ServiceEndpoint: link.Url})
+	}
+
+	resolution.DIDDocument = doc
+	return resolution, nil
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// base58Encode encodes with the bitcoin alphabet, as publicKeyBase58 expects
+func base58Encode(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
@@ -0,0 +1,68 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestBase58Encode(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		want string
+	}{
+		{[]byte{}, ""},
+		{[]byte{0}, "1"},
+		{[]byte{0, 0, 1}, "112"},
+		{[]byte{57}, "z"},
+		{[]byte{58}, "21"},
+		{[]byte("hello world"), "StV1DL6CwTryKyV"},
+		{[]byte{0, 0, 0, 0x28, 0x7f, 0xb4, 0xcd}, "111233QC4"},
+	}
+	for _, tt := range tests {
+		if got := base58Encode(tt.in); got != tt.want {
+			t.Errorf("base58Encode(%x) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseDID(t *testing.T) {
+	tests := []struct {
+		did         string
+		subjectType string
+		subjectID   string
+		wantErr     bool
+	}{
+		{did: "did:idman:person:jonsmith", subjectType: "person", subjectID: "jonsmith"},
+		{did: "did:idman:company:acme", subjectType: "company", subjectID: "acme"},
+		{did: "did:idman:company:a:b", subjectType: "company", subjectID: "a:b"},
+		{did: "did:idman:person:", wantErr: true},
+		{did: "did:idman:trust:acme", wantErr: true},
+		{did: "did:other:person:jonsmith", wantErr: true},
+		{did: "person:jonsmith", wantErr: true},
+		{did: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		subjectType, subjectID, err := parseDID(tt.did)
+		if (err != nil) != tt.wantErr || subjectType != tt.subjectType || subjectID != tt.subjectID {
+			t.Errorf("parseDID(%q) = %q, %q, %v", tt.did, subjectType, subjectID, err)
+		}
+	}
+
+	for _, subjectType := range []string{ownerTypePerson, ownerTypeCompany} {
+		did := didFor(subjectType, "x1")
+		if gotType, gotID, err := parseDID(did); err != nil || gotType != subjectType || gotID != "x1" {
+			t.Errorf("parseDID(didFor(%q, x1)) = %q, %q, %v", subjectType, gotType, gotID, err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: register and issue dates taken from the transaction
+
+The RegisterDate of a person or company and the IssueDate of a commercial
+paper are set to the transaction timestamp, so a submitter can't backdate a
+registration or an issue. A date the client supplies, as effectiveDate or as
+the registerDate or issueDate older clients send, is kept as the
+EffectiveDate of the record. It must lie within the effective date window
+around ledger time, which an admin sets with setEffectiveDateWindow. Records
+written before this keep the dates their clients supplied.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var effectiveWindowKey = "config:effectiveDateWindow"
+
+var maxEffectiveWindowDays = 3650
+
+// EffectiveDateWindow is how many days before and after ledger time an
+// effective date may fall
+type EffectiveDateWindow struct {
+	PastDays   int `json:"pastDays"`
+	FutureDays int `json:"futureDays"`
+}
+
+// Window used until setEffectiveDateWindow is called
+var defaultEffectiveWindow = EffectiveDateWindow{PastDays: 30, FutureDays: 0}
+
+// GetEffectiveDateWindow returns the effective date window in force
+func GetEffectiveDateWindow(stub *shim.ChaincodeStub) (EffectiveDateWindow, error) {
+	var window EffectiveDateWindow
+
+	windowBytes, err := stub.GetState(effectiveWindowKey)
+	if err != nil {
+		fmt.Println("Error retrieving effective date window")
+		return window, errors.New("Error retrieving effective date window")
+	}
+	if windowBytes == nil {
+		return defaultEffectiveWindow, nil
+	}
+
+	err = json.Unmarshal(windowBytes, &window)
+	if err != nil {
+		fmt.Println("Error unmarshalling effective date window")
+		return window, errors.New("Error unmarshalling effective date window")
+	}
+	return window, nil
+}
+
+func (t *SimpleChaincode) setEffectiveDateWindow(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	/*		0
+			json
+			{
+				"pastDays": 30,
+				"futureDays": 0
+			}
+	*/
+	if len(args) != 1 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting effective date window")
+	}
+	_, err := checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var window EffectiveDateWindow
+	err = json.Unmarshal([]byte(args[0]), &window)
+	if err != nil {
+		fmt.Println("error invalid effective date window")
+		return nil, errors.New("Invalid effective date window")
+	}
+	if window.PastDays < 0 || window.PastDays > maxEffectiveWindowDays ||
+		window.FutureDays < 0 || window.FutureDays > maxEffectiveWindowDays {
+		return nil, errors.New("Window days must be between 0 and " + strconv.Itoa(maxEffectiveWindowDays))
+	}
+
+	windowBytes, err := json.Marshal(&window)
+	if err != nil {
+		fmt.Println("Error marshalling effective date window")
+		return nil, errors.New("Error setting effective date window")
+	}
+	err = stub.PutState(effectiveWindowKey, windowBytes)
+	if err != nil {
+		fmt.Println("Error writing effective date window")
+		return nil, errors.New("Error setting effective date window")
+	}
+
+	fmt.Println("Effective date window set to " + strconv.Itoa(window.PastDays) + " days back, " + strconv.Itoa(window.FutureDays) + " days ahead")
+	return nil, nil
+}
+
+// stampTxTime sets a register or issue date to the transaction time. The date
+// the client supplied, in the effective date or failing that in the stamped
+// field, becomes the effective date once checked against the window.
+func stampTxTime(stub *shim.ChaincodeStub, field string, stamped *Timestamp, effective *Timestamp) error {
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+
+	if *effective == "" {
+		*effective = *stamped
+	}
+	*stamped = Timestamp(now.Format(timestampLayout))
+	if *effective == "" {
+		return nil
+	}
+
+	t, err := effective.Time()
+	if err != nil {
+		return errors.New("Invalid effective " + field + " " + string(*effective) + ", expecting epoch milliseconds, ISO-8601 or yyyy-mm-dd")
+	}
+	window, err := GetEffectiveDateWindow(stub)
+	if err != nil {
+		return err
+	}
+	// A plain date counts from the start of its day
+	earliest := now.AddDate(0, 0, -window.PastDays).Truncate(24 * time.Hour)
+	latest := now.AddDate(0, 0, window.FutureDays).Add(maxClockSkew)
+	if t.Before(earliest) || t.After(latest) {
+		return errors.New("Effective " + field + " " + string(*effective) + " must be within " +
+			strconv.Itoa(window.PastDays) + " days before and " + strconv.Itoa(window.FutureDays) + " days after " + string(*stamped))
+	}
+	return nil
+}
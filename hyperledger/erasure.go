@@ -0,0 +1,401 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: right to erasure of Person records
+
+erasePerson overwrites every personal field of a person with a tombstone,
+drops the claim hashes and the reference to its photo, and takes the person
+out of the person keys and the unique indexes. The person ID is derived from
+the name, so the stub is moved to an opaque ID, erased- and a keyed hash of
+the transaction ID and the old ID, which erasePerson returns. Erasing a
+person registered again under the same ID gives another opaque ID. The status list entry,
+verification records, consent log, held relationships and DID move to the
+opaque ID as well, consents are deleted and persons merged into the erased
+person are moved the same way. Nothing is left under the old ID, which can
+be registered again.
+
+The stub keeps the registrator, status history and the sha256 of the record
+as it was before erasure. CheckAttestation binds old attestations to that
+hash, so they still check as issued for the record, with the subject erased.
+
+Only the person, their registrator or an admin can request erasure. Accounts
+keep the owner ID they were opened with and fail the compliance check once
+the owner is erased. The ledger history still holds the earlier versions of
+the record; erasure only removes the personal data from the world state.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var erasurePrefix = "erasure:"
+var erasureKeysID = "ErasureKeys"
+
+// Erased persons are kept under this prefix and a keyed hash of their old ID
+var erasedIDPrefix = "erased-"
+
+// Value written over each erased field
+var erasedTombstone = "[erased]"
+
+// A person can be erased from any status but erased
+var eraseTransition = statusTransition{
+	from: []string{statusPending, statusActive, statusSuspended, statusSanctioned, statusRevoked, statusDeceased},
+	to:   statusErased,
+}
+
+// Erasure is the log entry of one erasePerson
+type Erasure struct {
+	PersonID    string `json:"personId"`
+	RequestedBy string `json:"requestedBy"`
+	Reason      string `json:"reason"`
+	Date        string `json:"date"`
+	RecordHash  string `json:"recordHash"`
+}
+
+// erasedID returns the opaque ID an erased person is kept under. The ID of a
+// person can be registered again after erasure, so the transaction ID goes
+// into the hash and an ID already in use is refused rather than overwritten.
+func erasedID(stub *shim.ChaincodeStub, personID string) (string, error) {
+	hash, err := keyedHash("erasure", stub.UUID+":"+personID)
+	if err != nil {
+		return "", err
+	}
+	id := erasedIDPrefix + hash[:32]
+
+	for _, key := range []string{personPrefix + id, erasurePrefix + id} {
+		existing, err := stub.GetState(key)
+		if err != nil {
+			fmt.Println("Error retrieving " + key)
+			return "", errors.New("Error retrieving " + key)
+		}
+		if existing != nil {
+			return "", errors.New("Erased ID " + id + " is already in use")
+		}
+	}
+	return id, nil
+}
+
+// tombstonePerson overwrites the personal fields of a person
+func tombstonePerson(person *Person) {
+	for _, field := range []*string{&person.FirstName, &person.LastName, &person.Email,
+		&person.Gender, &person.DrivingLicence, &person.TFN, &person.Address, &person.City,
+		&person.Postcode, &person.State, &person.DataPhoto} {
+		if *field != "" {
+			*field = erasedTombstone
+		}
+	}
+	if person.BirthDate != "" {
+		person.BirthDate = Timestamp(erasedTombstone)
+	}
+	person.UrlLinks = nil
+	person.Photo = nil
+	person.ClaimHashes = nil
+	person.EnrollmentID = ""
+}
+
+// rekeyVerifications moves the verification records of a person, and the
+// attestations issued for them, to the new ID
+func rekeyVerifications(stub *shim.ChaincodeStub, oldID string, newID string) error {
+	history, err := GetVerificationHistory(stub, ownerTypePerson, oldID)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for i, record := range history {
+		oldKey := record.ID
+		record.ID = verificationPrefix + ownerTypePerson + ":" + newID + ":" + strconv.Itoa(i)
+		record.SubjectID = newID
+		if record.Error != "" {
+			// Verification errors name the subject
+			record.Error = erasedTombstone
+		}
+		err = putRecord(stub, record.ID, &record)
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(oldKey)
+		if err != nil {
+			fmt.Println("Error deleting " + oldKey)
+			return errors.New("Error deleting " + oldKey)
+		}
+		keys = append(keys, record.ID)
+
+		// The signed statement keeps the old ID, the stored copy names the
+		// subject CheckAttestation looks up
+		if record.AttestationID != "" {
+			attestation, err := GetAttestation(stub, record.AttestationID)
+			if err != nil {
+				return err
+			}
+			attestation.Statement.SubjectID = newID
+			err = putRecord(stub, attestationPrefix+attestation.ID, &attestation)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	err = putKeyList(stub, verificationKeysPrefix+ownerTypePerson+":"+newID, keys)
+	if err != nil {
+		return err
+	}
+	return stub.DelState(verificationKeysPrefix + ownerTypePerson + ":" + oldID)
+}
+
+// rekeyConsents deletes the consents of a person and moves its consent log to
+// the new ID
+func rekeyConsents(stub *shim.ChaincodeStub, oldID string, newID string) error {
+	events, err := GetConsentLog(stub, oldID)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for i, event := range events {
+		err = stub.DelState(consentKey(oldID, event.RelyingParty))
+		if err != nil {
+			fmt.Println("Error deleting consent of " + event.RelyingParty)
+			return errors.New("Error deleting consent of " + event.RelyingParty)
+		}
+
+		oldKey := consentLogPrefix + oldID + ":" + strconv.Itoa(i)
+		event.PersonID = newID
+		if event.Actor == oldID {
+			event.Actor = newID
+		}
+		key := consentLogPrefix + newID + ":" + strconv.Itoa(i)
+		err = putRecord(stub, key, &event)
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(oldKey)
+		if err != nil {
+			fmt.Println("Error deleting " + oldKey)
+			return errors.New("Error deleting " + oldKey)
+		}
+		keys = append(keys, key)
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	err = putKeyList(stub, consentLogKeysPrefix+newID, keys)
+	if err != nil {
+		return err
+	}
+	return stub.DelState(consentLogKeysPrefix + oldID)
+}
+
+// rekeyDID moves the DID of a person to the new ID and deactivates it
+func rekeyDID(stub *shim.ChaincodeStub, oldID string, newID string, date string) error {
+	err := moveDID(stub, ownerTypePerson, newID, oldID, date)
+	if err != nil {
+		return err
+	}
+	record, err := getDIDRecord(stub, didFor(ownerTypePerson, newID))
+	if err != nil {
+		// No DID was registered
+		return nil
+	}
+	record.Deactivated = true
+	return putDIDRecord(stub, record)
+}
+
+// rekeyPerson moves what the ledger keeps under the ID of a person to the
+// new ID: its place in the status list, verifications, consents, held
+// relationships and DID. The record itself is left to the caller.
+func rekeyPerson(stub *shim.ChaincodeStub, oldID string, newID string, date string) error {
+	err := replaceKey(stub, statusListKeysPrefix+ownerTypePerson, oldID, newID)
+	if err != nil {
+		return err
+	}
+	err = rekeyVerifications(stub, oldID, newID)
+	if err != nil {
+		return err
+	}
+	err = rekeyConsents(stub, oldID, newID)
+	if err != nil {
+		return err
+	}
+	_, err = moveHeldRelationships(stub, ownerTypePerson, newID, oldID)
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(holderRelKeys(ownerTypePerson, oldID))
+	if err != nil {
+		fmt.Println("Error deleting relationships of " + oldID)
+		return errors.New("Error deleting relationships of " + oldID)
+	}
+	return rekeyDID(stub, oldID, newID, date)
+}
+
+// scrubActors replaces a person's own ID in its status history
+func scrubActors(history []StatusChange, oldID string, newID string) {
+	for i := range history {
+		if history[i].Actor == oldID {
+			history[i].Actor = newID
+		}
+	}
+}
+
+func (t *SimpleChaincode) erasePerson(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	/*		0			1
+			"personId"	"reason"
+	*/
+	if len(args) != 2 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting person ID and reason")
+	}
+
+	recordBytes, err := stub.GetState(personPrefix + args[0])
+	if err != nil || recordBytes == nil {
+		return nil, errors.New("Person " + args[0] + " not found")
+	}
+	var person Person
+	err = json.Unmarshal(recordBytes, &person)
+	if err != nil {
+		fmt.Println("Error unmarshalling person " + args[0])
+		return nil, errors.New("Error unmarshalling person " + args[0])
+	}
+
+	requester, err := checkSubjectAccess(stub, ownerTypePerson, person.ID)
+	if err != nil {
+		return nil, errors.New("Only person " + person.ID + ", their registrator or an admin can request erasure")
+	}
+	newID, err := erasedID(stub, person.ID)
+	if err != nil {
+		return nil, err
+	}
+	if isSubject(requester, person.EnrollmentID) {
+		requester = newID
+	}
+	change, err := newStatusChange(stub, eraseTransition, person.Status, args[1], requester)
+	if err != nil {
+		fmt.Println("Error erasing person " + person.ID)
+		return nil, err
+	}
+
+	err = countPhotoRef(stub, person.Photo, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	err = removeIndexes(stub, ownerTypePerson, person.ID, personIndexValues(person))
+	if err != nil {
+		return nil, err
+	}
+	err = rekeyPerson(stub, person.ID, newID, change.Date)
+	if err != nil {
+		return nil, err
+	}
+
+	// Persons merged into this one are the same person under another ID
+	var mergedFrom []string
+	for _, duplicateID := range person.MergedFrom {
+		var duplicate Person
+		err = getRecord(stub, ownerTypePerson, duplicateID, &duplicate)
+		if err != nil {
+			return nil, err
+		}
+		duplicate.ID, err = erasedID(stub, duplicateID)
+		if err != nil {
+			return nil, err
+		}
+		duplicate.MergedInto = newID
+		scrubActors(duplicate.StatusHistory, duplicateID, duplicate.ID)
+		err = rekeyPerson(stub, duplicateID, duplicate.ID, change.Date)
+		if err != nil {
+			return nil, err
+		}
+		err = putRecord(stub, personPrefix+duplicate.ID, &duplicate)
+		if err != nil {
+			return nil, err
+		}
+		err = stub.DelState(personPrefix + duplicateID)
+		if err != nil {
+			fmt.Println("Error deleting person " + duplicateID)
+			return nil, errors.New("Error erasing person " + person.ID)
+		}
+		mergedFrom = append(mergedFrom, duplicate.ID)
+	}
+
+	sum := sha256.Sum256(recordBytes)
+	erasure := Erasure{PersonID: newID, RequestedBy: requester, Reason: args[1], Date: change.Date,
+		RecordHash: hex.EncodeToString(sum[:])}
+
+	oldID := person.ID
+	tombstonePerson(&person)
+	person.ID = newID
+	person.MergedFrom = mergedFrom
+	scrubActors(person.StatusHistory, oldID, newID)
+	person.Status = change.To
+	person.StatusHistory = append(person.StatusHistory, change)
+	person.ErasedRecordHash = erasure.RecordHash
+
+	err = putRecord(stub, personPrefix+person.ID, &person)
+	if err != nil {
+		return nil, errors.New("Error erasing person " + oldID)
+	}
+	err = stub.DelState(personPrefix + oldID)
+	if err != nil {
+		fmt.Println("Error deleting person " + oldID)
+		return nil, errors.New("Error erasing person " + oldID)
+	}
+	err = removeKey(stub, personKeysID, personPrefix+oldID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = putRecord(stub, erasurePrefix+person.ID, &erasure)
+	if err != nil {
+		return nil, errors.New("Error logging erasure of person " + person.ID)
+	}
+	err = appendKey(stub, erasureKeysID, erasurePrefix+person.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Person erased as " + person.ID + " at the request of " + requester)
+	return []byte(person.ID), nil
+}
+
+// GetErasure returns the log entry of the erasure of a person, by the ID the
+// person was erased under
+func GetErasure(stub *shim.ChaincodeStub, personID string) (Erasure, error) {
+	var erasure Erasure
+
+	erasureBytes, err := stub.GetState(erasurePrefix + personID)
+	if err != nil || erasureBytes == nil {
+		return erasure, errors.New("No erasure found for " + personID)
+	}
+	err = json.Unmarshal(erasureBytes, &erasure)
+	if err != nil {
+		fmt.Println("Error unmarshalling erasure of " + personID)
+		return erasure, errors.New("Error unmarshalling erasure of " + personID)
+	}
+	return erasure, nil
+}
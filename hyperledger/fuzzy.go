@@ -0,0 +1,133 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: normalisation and fuzzy comparison of free-text fields
+*/
+
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Similarity at or above which two free-text values match, unless the
+// verification policy sets its own fuzzyThreshold
+var defaultFuzzyThreshold = 0.85
+
+// Abbreviations expanded before free-text values are compared
+var textAbbreviations = map[string]string{
+	"st":    "street",
+	"str":   "street",
+	"rd":    "road",
+	"ave":   "avenue",
+	"av":    "avenue",
+	"dr":    "drive",
+	"ct":    "court",
+	"pl":    "place",
+	"cres":  "crescent",
+	"cr":    "crescent",
+	"hwy":   "highway",
+	"pde":   "parade",
+	"tce":   "terrace",
+	"ln":    "lane",
+	"blvd":  "boulevard",
+	"cl":    "close",
+	"esp":   "esplanade",
+	"sq":    "square",
+	"mt":    "mount",
+	"apt":   "apartment",
+	"lvl":   "level",
+	"ltd":   "limited",
+	"pty":   "proprietary",
+	"co":    "company",
+	"corp":  "corporation",
+	"inc":   "incorporated",
+	"assn":  "association",
+	"intl":  "international",
+	"bros":  "brothers",
+	"&":     "and",
+	"mgmt":  "management",
+	"svcs":  "services",
+	"hldgs": "holdings",
+}
+
+// normaliseText lower-cases a free-text value, drops punctuation, collapses
+// whitespace and expands common abbreviations, so that "12 Smith St." and
+// "12  smith street" compare equal
+func normaliseText(s string) string {
+	s = strings.ToLower(s)
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '&' {
+			return r
+		}
+		return ' '
+	}, s)
+
+	tokens := strings.Fields(s)
+	for i, tok := range tokens {
+		if full, ok := textAbbreviations[tok]; ok {
+			tokens[i] = full
+		}
+	}
+	return strings.Join(tokens, " ")
+}
+
+// editDistance is the Levenshtein distance between a and b, counted in runes
+func editDistance(a, b string) int {
+	ra := []rune(a)
+	rb := []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(minInt(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// textSimilarity compares two free-text values after normalisation and returns
+// 1 for equal values down to 0 for entirely different ones
+func textSimilarity(a, b string) float64 {
+	na := normaliseText(a)
+	nb := normaliseText(b)
+	if na == nb {
+		return 1.0
+	}
+
+	longest := len([]rune(na))
+	if l := len([]rune(nb)); l > longest {
+		longest = l
+	}
+	return 1.0 - float64(editDistance(na, nb))/float64(longest)
+}
@@ -0,0 +1,90 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNormaliseText(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"12 Smith St.", "12 smith street"},
+		{"  12   SMITH   street ", "12 smith street"},
+		{"Acme Pty. Ltd.", "acme proprietary limited"},
+		{"Smith & Sons", "smith and sons"},
+		{"O'Brien-Jones", "o brien jones"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normaliseText(tt.in); got != tt.want {
+			t.Errorf("normaliseText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"", "abc", 3},
+		{"kitten", "sitting", 3},
+		{"flaw", "lawn", 2},
+		{"müller", "muller", 1},
+		{"same", "same", 0},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestTextSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"12 Smith St.", "12  smith street", 1},
+		{"Acme Pty Ltd", "ACME Proprietary Limited", 1},
+		{"", "", 1},
+		{"abc", "xyz", 0},
+		{"abc", "", 0},
+		{"kitten", "sitting", 1 - 3.0/7},
+		{"Melbourne", "Melbourn", 1 - 1.0/9},
+	}
+	for _, tt := range tests {
+		got := textSimilarity(tt.a, tt.b)
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("textSimilarity(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+		if back := textSimilarity(tt.b, tt.a); back != got {
+			t.Errorf("textSimilarity(%q, %q) = %v, not symmetric with %v", tt.b, tt.a, back, got)
+		}
+	}
+
+	if textSimilarity("Jonathon Smith", "Jonathan Smith") < defaultFuzzyThreshold {
+		t.Errorf("a one letter misspelling should match at the default threshold")
+	}
+	if textSimilarity("Jon Smith", "Jane Doe") >= defaultFuzzyThreshold {
+		t.Errorf("different names should not match at the default threshold")
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package idcheck holds the checks of ID-Man records that the chaincode and the
+idman-csv tool both make, so that a row the tool accepts is one the chaincode
+accepts. The chaincode is a main package and can't be imported, so anything
+both need lives here. It depends on nothing but the standard library.
+*/
+package idcheck
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DateLayout is the layout of a plain date
+const DateLayout = "2006-01-02"
+
+// ISO-8601 timestamp without a zone, taken to be UTC
+var localTimestampLayout = "2006-01-02T15:04:05"
+
+var epochMillisPattern = regexp.MustCompile(`^-?[0-9]+$`)
+
+// MinEpochMillisDigits is the fewest digits epoch milliseconds are read from.
+// Shorter numbers fall within about a day of 1970-01-01 and are far more
+// likely an ISO-8601 basic date, such as 19800101, or a year, so they are
+// rejected rather than guessed at.
+var MinEpochMillisDigits = 9
+
+// ParseDate reads a date held as epoch milliseconds (negative before 1970),
+// an RFC3339 timestamp, an ISO-8601 timestamp without a zone or a plain
+// yyyy-mm-dd date, and tells whether it was a plain date. Dates are returned
+// in UTC.
+func ParseDate(s string) (time.Time, bool, error) {
+	if epochMillisPattern.MatchString(s) {
+		if len(strings.TrimPrefix(s, "-")) < MinEpochMillisDigits {
+			return time.Time{}, false, errors.New("Ambiguous date " + s + ", expecting yyyy-mm-dd, ISO-8601 or epoch milliseconds of at least " + strconv.Itoa(MinEpochMillisDigits) + " digits")
+		}
+		ms, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, false, errors.New("Invalid date " + s)
+		}
+		return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC(), false, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), false, nil
+	}
+	if t, err := time.Parse(localTimestampLayout, s); err == nil {
+		return t, false, nil
+	}
+	if t, err := time.Parse(DateLayout, s); err == nil {
+		return t, true, nil
+	}
+	return time.Time{}, false, errors.New("Invalid date " + s + ", expecting epoch milliseconds, ISO-8601 or yyyy-mm-dd")
+}
+
+// MaxClockSkew is how far ahead of the current time a date may be before it
+// counts as in the future, to allow for clock skew between client and peers
+var MaxClockSkew = 5 * time.Minute
+
+// Link types of a UrlLink
+const (
+	LinkTypeWebsite         = "website"
+	LinkTypeLinkedIn        = "linkedin"
+	LinkTypeRegistryExtract = "registry-extract"
+	LinkTypeDocument        = "document"
+)
+
+// KnownLinkTypes lists every link type a record may hold
+var KnownLinkTypes = []string{LinkTypeWebsite, LinkTypeLinkedIn, LinkTypeRegistryExtract, LinkTypeDocument}
+
+// IsKnownLinkType reports whether linkType is one of KnownLinkTypes
+func IsKnownLinkType(linkType string) bool {
+	for _, t := range KnownLinkTypes {
+		if t == linkType {
+			return true
+		}
+	}
+	return false
+}
+
+// CanonicalURL is the form URLs are compared in to find duplicates
+func CanonicalURL(u *url.URL) string {
+	c := *u
+	c.Scheme = strings.ToLower(c.Scheme)
+	c.Host = strings.ToLower(c.Host)
+	return strings.TrimSuffix(c.String(), "/")
+}
+
+// ParseLink checks the type and URL of a link and returns the canonical URL.
+// Links are absolute http or https URLs with a host and no user info.
+func ParseLink(rawURL string, linkType string) (string, error) {
+	if !IsKnownLinkType(linkType) {
+		return "", errors.New("Unknown link type " + linkType + ", expecting one of " + strings.Join(KnownLinkTypes, ", "))
+	}
+
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return "", errors.New("Invalid URL " + rawURL)
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return "", errors.New("URL " + rawURL + " must be http or https")
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" || u.User != nil {
+		return "", errors.New("URL " + rawURL + " must have a host and no user info")
+	}
+	if linkType == LinkTypeLinkedIn && host != "linkedin.com" && !strings.HasSuffix(host, ".linkedin.com") {
+		return "", errors.New("A linkedin link must point to linkedin.com, not " + host)
+	}
+	return CanonicalURL(u), nil
+}
+
+// PersonID derives the ID of a person from their names
+func PersonID(firstName string, lastName string) string {
+	id := strings.ToLower(firstName) + strings.ToLower(lastName)
+	return strings.Replace(id, " ", "", -1) //remove all spaces
+}
+
+// CompanyID derives the ID of a company from its name
+func CompanyID(name string) string {
+	return strings.Replace(strings.ToLower(name), " ", "", -1) //remove all spaces
+}
@@ -0,0 +1,313 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: unique secondary indexes of Person and Company records
+
+IDs are derived from names, so the same person or company can be registered
+twice under a slightly different name. The identifiers below must be unique
+across the registry. Each is kept in an index key holding the ID of the
+record, and a registration that reuses one is rejected with the ID of the
+record already holding it. Values are normalised before they are indexed, so
+"12 345 678" and "12345678" clash, and the index key holds a keyed hash of
+the normalised value rather than the value itself.
+
+The indexes are kept up to date on registration, erasure and merging, and
+back the FindPerson* and FindCompany* lookup queries. TFNs are only indexed
+for uniqueness; there is deliberately no query finding a person by TFN.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var indexPrefix = "idx:"
+
+// uniqueIndex is one unique identifier of a record type
+type uniqueIndex struct {
+	field     string
+	normalise func(string) string
+}
+
+// digitsOnly keeps the digits of an identifier such as a TFN, ABN or ACN
+func digitsOnly(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// alphanumericUpper keeps the letters and digits of a licence number
+func alphanumericUpper(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return -1
+	}, s)
+}
+
+func normaliseEmail(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+var personIndexes = []uniqueIndex{
+	{field: "email", normalise: normaliseEmail},
+	{field: "tfn", normalise: digitsOnly},
+	{field: "drivingLicence", normalise: alphanumericUpper},
+}
+
+var companyIndexes = []uniqueIndex{
+	{field: "abn", normalise: digitsOnly},
+	{field: "acn", normalise: digitsOnly},
+}
+
+// indexEntry is the index key of one identifier of a record
+type indexEntry struct {
+	field string
+	key   string
+	// Key the value was indexed under before index keys were hashed
+	legacyKey string
+}
+
+// indexKey is the state key of one normalised value of a unique index
+func indexKey(subjectType string, field string, value string) (string, error) {
+	hash, err := keyedHash("index", subjectType+":"+field+":"+value)
+	if err != nil {
+		return "", err
+	}
+	return indexPrefix + subjectType + ":" + field + ":" + hash, nil
+}
+
+// indexedValues returns the index keys of a person or company, in the order
+// of personIndexes or companyIndexes
+func indexedValues(subjectType string, values map[string]string) ([]indexEntry, error) {
+	indexes := personIndexes
+	if subjectType == ownerTypeCompany {
+		indexes = companyIndexes
+	}
+
+	var entries []indexEntry
+	for _, index := range indexes {
+		value := index.normalise(values[index.field])
+		if value == "" {
+			continue
+		}
+		key, err := indexKey(subjectType, index.field, value)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, indexEntry{field: index.field, key: key,
+			legacyKey: indexPrefix + subjectType + ":" + index.field + ":" + value})
+	}
+	return entries, nil
+}
+
+func personIndexValues(person Person) map[string]string {
+	return map[string]string{"email": person.Email, "tfn": person.TFN, "drivingLicence": person.DrivingLicence}
+}
+
+func companyIndexValues(company Company) map[string]string {
+	return map[string]string{"abn": company.ABN, "acn": company.ACN}
+}
+
+// indexHolder returns the first identifier of a record, in index order, that
+// is held by a record other than subjectID, and the ID of that record. Both
+// are blank when every identifier is free.
+func indexHolder(stub *shim.ChaincodeStub, subjectType string, subjectID string, values map[string]string) (string, string, error) {
+	entries, err := indexedValues(subjectType, values)
+	if err != nil {
+		return "", "", err
+	}
+	for _, entry := range entries {
+		existing, err := stub.GetState(entry.key)
+		if err != nil {
+			fmt.Println("Error retrieving " + entry.field + " index")
+			return "", "", errors.New("Error checking " + entry.field + " is unique")
+		}
+		if existing != nil && string(existing) != subjectID {
+			return entry.field, string(existing), nil
+		}
+	}
+	return "", "", nil
+}
+
+// checkUniqueIndexes rejects a record whose identifiers are already held by
+// another record. The error doesn't name the other record, which would tell
+// anyone whose email or licence it is.
+func checkUniqueIndexes(stub *shim.ChaincodeStub, subjectType string, subjectID string, values map[string]string) error {
+	field, existing, err := indexHolder(stub, subjectType, subjectID, values)
+	if err != nil {
+		return err
+	}
+	if existing != "" {
+		return errors.New("A " + subjectType + " with this " + field + " is already registered")
+	}
+	return nil
+}
+
+// putIndexes points the index keys of a record at it
+func putIndexes(stub *shim.ChaincodeStub, subjectType string, subjectID string, values map[string]string) error {
+	entries, err := indexedValues(subjectType, values)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = stub.PutState(entry.key, []byte(subjectID))
+		if err != nil {
+			fmt.Println("Error writing " + entry.field + " index")
+			return errors.New("Error indexing " + entry.field + " of " + subjectType + " " + subjectID)
+		}
+	}
+	return nil
+}
+
+// removeIndexes deletes the index keys that point at a record
+func removeIndexes(stub *shim.ChaincodeStub, subjectType string, subjectID string, values map[string]string) error {
+	entries, err := indexedValues(subjectType, values)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		existing, err := stub.GetState(entry.key)
+		if err != nil {
+			fmt.Println("Error retrieving " + entry.field + " index")
+			return errors.New("Error removing " + entry.field + " index of " + subjectType + " " + subjectID)
+		}
+		if string(existing) != subjectID {
+			continue
+		}
+		err = stub.DelState(entry.key)
+		if err != nil {
+			fmt.Println("Error deleting " + entry.field + " index")
+			return errors.New("Error removing " + entry.field + " index of " + subjectType + " " + subjectID)
+		}
+	}
+	return nil
+}
+
+// indexLegacyRecords indexes records registered before the unique indexes
+// existed, and deletes the index keys that held the plain value. When two
+// legacy records clash the first one keeps the index. It is run from Init.
+func indexLegacyRecords(stub *shim.ChaincodeStub) error {
+	personKeys, err := getKeyList(stub, personKeysID)
+	if err != nil {
+		return err
+	}
+	for _, key := range personKeys {
+		person, err := GetPerson(strings.TrimPrefix(key, personPrefix), stub)
+		if err != nil {
+			continue
+		}
+		err = indexLegacyRecord(stub, ownerTypePerson, person.ID, personIndexValues(person))
+		if err != nil {
+			return err
+		}
+	}
+
+	companyKeys, err := getKeyList(stub, companyKeysID)
+	if err != nil {
+		return err
+	}
+	for _, key := range companyKeys {
+		company, err := GetCompany(strings.TrimPrefix(key, companyPrefix), stub)
+		if err != nil {
+			continue
+		}
+		err = indexLegacyRecord(stub, ownerTypeCompany, company.ID, companyIndexValues(company))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func indexLegacyRecord(stub *shim.ChaincodeStub, subjectType string, subjectID string, values map[string]string) error {
+	entries, err := indexedValues(subjectType, values)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = stub.DelState(entry.legacyKey)
+		if err != nil {
+			fmt.Println("Error deleting plain " + entry.field + " index")
+			return errors.New("Error indexing legacy " + subjectType + " " + subjectID)
+		}
+
+		existing, err := stub.GetState(entry.key)
+		if err != nil {
+			fmt.Println("Error retrieving " + entry.field + " index")
+			return errors.New("Error indexing legacy " + subjectType + " " + subjectID)
+		}
+		if existing != nil {
+			if string(existing) != subjectID {
+				fmt.Println(subjectType + " " + subjectID + " has the same " + entry.field + " as " + string(existing))
+			}
+			continue
+		}
+		err = stub.PutState(entry.key, []byte(subjectID))
+		if err != nil {
+			fmt.Println("Error writing " + entry.field + " index")
+			return errors.New("Error indexing legacy " + subjectType + " " + subjectID)
+		}
+	}
+	return nil
+}
+
+// findByIndex returns the ID of the record holding an identifier
+func findByIndex(stub *shim.ChaincodeStub, subjectType string, field string, value string) (string, error) {
+	entries, err := indexedValues(subjectType, map[string]string{field: value})
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "", errors.New("No " + field + " to look up")
+	}
+	id, err := stub.GetState(entries[0].key)
+	if err != nil {
+		fmt.Println("Error retrieving " + field + " index")
+		return "", errors.New("Error looking up " + subjectType + " by " + field)
+	}
+	if id == nil {
+		return "", errors.New("No " + subjectType + " registered with this " + field)
+	}
+	return string(id), nil
+}
+
+// FindPerson returns the person holding an email, TFN or driving licence
+func FindPerson(stub *shim.ChaincodeStub, field string, value string) (Person, error) {
+	id, err := findByIndex(stub, ownerTypePerson, field, value)
+	if err != nil {
+		return Person{}, err
+	}
+	return GetPerson(id, stub)
+}
+
+// FindCompany returns the company holding an ABN or ACN
+func FindCompany(stub *shim.ChaincodeStub, field string, value string) (Company, error) {
+	id, err := findByIndex(stub, ownerTypeCompany, field, value)
+	if err != nil {
+		return Company{}, err
+	}
+	return GetCompany(id, stub)
+}
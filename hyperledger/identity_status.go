@@ -0,0 +1,241 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: identity lifecycle status of Person and Company records
+
+Only admins can move a record between statuses. The history records the
+enrollment ID of the admin as the actor.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Identity record statuses. Records saved before statuses existed have a
+// blank status and are treated as active.
+const (
+	statusPending      = "pending"
+	statusActive       = "active"
+	statusSuspended    = "suspended"
+	statusSanctioned   = "sanctioned"
+	statusRevoked      = "revoked"
+	statusDeceased     = "deceased"
+	statusDeregistered = "deregistered"
+	statusErased       = "erased"
+	statusMerged       = "merged"
+)
+
+var knownStatuses = []string{statusPending, statusActive, statusSuspended, statusSanctioned, statusRevoked, statusDeceased, statusDeregistered, statusErased, statusMerged}
+
+// StatusChange is one entry of the status history kept on a Person or Company
+type StatusChange struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Reason string `json:"reason"`
+	Actor  string `json:"actor"`
+	Date   string `json:"date"`
+}
+
+type statusTransition struct {
+	from []string
+	to   string
+}
+
+// Invoke functions that move a Person between statuses
+var personTransitions = map[string]statusTransition{
+	"activatePerson":  {from: []string{statusPending}, to: statusActive},
+	"suspendPerson":   {from: []string{statusActive}, to: statusSuspended},
+	"sanctionPerson":  {from: []string{statusActive, statusSuspended}, to: statusSanctioned},
+	"reinstatePerson": {from: []string{statusSuspended, statusSanctioned}, to: statusActive},
+	"revokePerson":    {from: []string{statusPending, statusActive, statusSuspended, statusSanctioned}, to: statusRevoked},
+	"markDeceased":    {from: []string{statusPending, statusActive, statusSuspended, statusSanctioned}, to: statusDeceased},
+}
+
+// Invoke functions that move a Company between statuses
+var companyTransitions = map[string]statusTransition{
+	"activateCompany":   {from: []string{statusPending}, to: statusActive},
+	"suspendCompany":    {from: []string{statusActive}, to: statusSuspended},
+	"sanctionCompany":   {from: []string{statusActive, statusSuspended}, to: statusSanctioned},
+	"reinstateCompany":  {from: []string{statusSuspended, statusSanctioned}, to: statusActive},
+	"revokeCompany":     {from: []string{statusPending, statusActive, statusSuspended, statusSanctioned}, to: statusRevoked},
+	"deregisterCompany": {from: []string{statusPending, statusActive, statusSuspended, statusSanctioned}, to: statusDeregistered},
+}
+
+// effectiveStatus maps the blank status of legacy records to active
+func effectiveStatus(status string) string {
+	if status == "" {
+		return statusActive
+	}
+	return status
+}
+
+func isKnownStatus(status string) bool {
+	for _, s := range knownStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// txTime returns the timestamp of the current transaction
+func txTime(stub *shim.ChaincodeStub) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil || ts == nil {
+		fmt.Println("Error getting transaction timestamp")
+		return time.Time{}, errors.New("Error getting transaction timestamp")
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+// newStatusChange checks that a transition is allowed from the current status
+// and builds the history entry for it
+func newStatusChange(stub *shim.ChaincodeStub, tr statusTransition, current string, reason string, actor string) (StatusChange, error) {
+	var change StatusChange
+
+	current = effectiveStatus(current)
+	allowed := false
+	for _, from := range tr.from {
+		if from == current {
+			allowed = true
+		}
+	}
+	if allowed == false {
+		return change, errors.New("Can't change status from " + current + " to " + tr.to)
+	}
+	if reason == "" || actor == "" {
+		return change, errors.New("A reason and an actor are required to change status")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return change, err
+	}
+
+	change = StatusChange{From: current, To: tr.to, Reason: reason, Actor: actor, Date: now.Format(time.RFC3339)}
+	return change, nil
+}
+
+func (t *SimpleChaincode) changePersonStatus(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
+
+	/*		0			1
+			"personId"	"reason"
+	*/
+	if len(args) != 2 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting person ID and reason")
+	}
+	actor, err := checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	tr, ok := personTransitions[function]
+	if !ok {
+		return nil, errors.New("Unknown person status change " + function)
+	}
+
+	person, err := GetPerson(args[0], stub)
+	if err != nil {
+		return nil, err
+	}
+
+	change, err := newStatusChange(stub, tr, person.Status, args[1], actor)
+	if err != nil {
+		fmt.Println("Error changing status of person " + person.ID)
+		return nil, err
+	}
+	person.Status = change.To
+	person.StatusHistory = append(person.StatusHistory, change)
+
+	persBytes, err := json.Marshal(&person)
+	if err != nil {
+		fmt.Println("Error marshalling person")
+		return nil, errors.New("Error changing status of person " + person.ID)
+	}
+	err = stub.PutState(personPrefix+person.ID, persBytes)
+	if err != nil {
+		fmt.Println("Error writing person " + person.ID)
+		return nil, errors.New("Error changing status of person " + person.ID)
+	}
+
+	fmt.Println("Person " + person.ID + " is now " + person.Status)
+	return nil, nil
+}
+
+func (t *SimpleChaincode) changeCompanyStatus(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
+
+	/*		0			1
+			"companyId"	"reason"
+	*/
+	if len(args) != 2 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting company ID and reason")
+	}
+	actor, err := checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	tr, ok := companyTransitions[function]
+	if !ok {
+		return nil, errors.New("Unknown company status change " + function)
+	}
+
+	company, err := GetCompany(args[0], stub)
+	if err != nil {
+		return nil, err
+	}
+
+	change, err := newStatusChange(stub, tr, company.Status, args[1], actor)
+	if err != nil {
+		fmt.Println("Error changing status of company " + company.ID)
+		return nil, err
+	}
+	company.Status = change.To
+	company.StatusHistory = append(company.StatusHistory, change)
+
+	compBytes, err := json.Marshal(&company)
+	if err != nil {
+		fmt.Println("Error marshalling company")
+		return nil, errors.New("Error changing status of company " + company.ID)
+	}
+	err = stub.PutState(companyPrefix+company.ID, compBytes)
+	if err != nil {
+		fmt.Println("Error writing company " + company.ID)
+		return nil, errors.New("Error changing status of company " + company.ID)
+	}
+
+	fmt.Println("Company " + company.ID + " is now " + company.Status)
+	return nil, nil
+}
+
+// statusFilterArg reads the optional status filter of the GetAll* queries
+func statusFilterArg(args []string) (string, error) {
+	if len(args) < 2 || args[1] == "" {
+		return "", nil
+	}
+	if !isKnownStatus(args[1]) {
+		return "", errors.New("Unknown status " + args[1])
+	}
+	return args[1], nil
+}
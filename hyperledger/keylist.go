@@ -0,0 +1,122 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: key collections, stored as a json array of keys under a well known
+key in the same way as PaperKeys, PersKeys and CompKeys
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// getKeyList reads a key collection. A collection that was never written is
+// returned empty.
+func getKeyList(stub *shim.ChaincodeStub, listKey string) ([]string, error) {
+	var keys []string
+
+	keysBytes, err := stub.GetState(listKey)
+	if err != nil {
+		fmt.Println("Error retrieving " + listKey)
+		return nil, errors.New("Error retrieving " + listKey)
+	}
+	if keysBytes == nil {
+		return keys, nil
+	}
+
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling " + listKey)
+		return nil, errors.New("Error unmarshalling " + listKey)
+	}
+	return keys, nil
+}
+
+// putKeyList writes a key collection back
+func putKeyList(stub *shim.ChaincodeStub, listKey string, keys []string) error {
+	keysBytes, err := json.Marshal(&keys)
+	if err != nil {
+		fmt.Println("Error marshalling " + listKey)
+		return errors.New("Error marshalling " + listKey)
+	}
+	err = stub.PutState(listKey, keysBytes)
+	if err != nil {
+		fmt.Println("Error writing " + listKey)
+		return errors.New("Error writing " + listKey)
+	}
+	return nil
+}
+
+// keyIndex returns the position of key in keys, or -1
+func keyIndex(keys []string, key string) int {
+	for i, k := range keys {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// withoutKey returns keys with every occurrence of key dropped. The result is
+// never nil, so that it is written as an empty list.
+func withoutKey(keys []string, key string) []string {
+	kept := []string{}
+	for _, k := range keys {
+		if k != key {
+			kept = append(kept, k)
+		}
+	}
+	return kept
+}
+
+// appendKey adds key to a collection unless it is already there
+func appendKey(stub *shim.ChaincodeStub, listKey string, key string) error {
+	keys, err := getKeyList(stub, listKey)
+	if err != nil {
+		return err
+	}
+	if keyIndex(keys, key) >= 0 {
+		return nil
+	}
+	return putKeyList(stub, listKey, append(keys, key))
+}
+
+// removeKey drops key from a collection
+func removeKey(stub *shim.ChaincodeStub, listKey string, key string) error {
+	keys, err := getKeyList(stub, listKey)
+	if err != nil {
+		return err
+	}
+	return putKeyList(stub, listKey, withoutKey(keys, key))
+}
+
+// replaceKey swaps key for replacement in a collection, keeping its position
+func replaceKey(stub *shim.ChaincodeStub, listKey string, key string, replacement string) error {
+	keys, err := getKeyList(stub, listKey)
+	if err != nil {
+		return err
+	}
+	i := keyIndex(keys, key)
+	if i < 0 {
+		return nil
+	}
+	keys[i] = replacement
+	return putKeyList(stub, listKey, keys)
+}
@@ -0,0 +1,58 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeyIndex(t *testing.T) {
+	tests := []struct {
+		keys []string
+		key  string
+		want int
+	}{
+		{nil, "a", -1},
+		{[]string{"a", "b", "c"}, "a", 0},
+		{[]string{"a", "b", "c"}, "c", 2},
+		{[]string{"a", "b", "c"}, "d", -1},
+		{[]string{"a", "b", "a"}, "a", 0},
+	}
+	for _, tt := range tests {
+		if got := keyIndex(tt.keys, tt.key); got != tt.want {
+			t.Errorf("keyIndex(%q, %q) = %d, want %d", tt.keys, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestWithoutKey(t *testing.T) {
+	tests := []struct {
+		keys []string
+		key  string
+		want []string
+	}{
+		{nil, "a", []string{}},
+		{[]string{"a"}, "a", []string{}},
+		{[]string{"a", "b", "c"}, "b", []string{"a", "c"}},
+		{[]string{"a", "b", "a"}, "a", []string{"b"}},
+		{[]string{"a", "b"}, "c", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		if got := withoutKey(tt.keys, tt.key); got == nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("withoutKey(%q, %q) = %#v, want %q", tt.keys, tt.key, got, tt.want)
+		}
+	}
+}
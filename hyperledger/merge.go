@@ -0,0 +1,497 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: merging duplicate Person and Company records
+
+mergePersons and mergeCompanies fold a duplicate record into a survivor. The
+survivor gains the links, relationships and DID of the duplicate, and when it
+has none of its own, its photo. A merged person also passes on the consents
+it holds for relying parties the survivor has no consent for. The unique
+identifiers of the duplicate are dropped from the indexes. The duplicate key
+is left holding a redirect tombstone with no personal data, which GetPerson
+and GetCompany follow to the survivor; the queries report the ID they were
+redirected from.
+
+A holding of one of two merged companies in the other ends on the merge date.
+Every shareholding that moves is checked as a new one would be, and a merge
+that would create an ownership cycle or take a company over 100% is rejected.
+
+Only callers holding the admin role attribute can merge records.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Redirect chains are not followed further than this
+var maxRedirects = 10
+
+// A record can be merged away from any status but erased or merged
+var mergeTransition = statusTransition{
+	from: []string{statusPending, statusActive, statusSuspended, statusSanctioned, statusRevoked, statusDeceased, statusDeregistered},
+	to:   statusMerged,
+}
+
+// followPersonRedirect returns the person a merged person was merged into
+func followPersonRedirect(stub *shim.ChaincodeStub, person Person) (Person, error) {
+	for i := 0; person.MergedInto != ""; i++ {
+		if i == maxRedirects {
+			return person, errors.New("Too many redirects from person " + person.ID)
+		}
+		persBytes, err := stub.GetState(personPrefix + person.MergedInto)
+		if err != nil || persBytes == nil {
+			return person, errors.New("Person " + person.ID + " was merged into missing person " + person.MergedInto)
+		}
+		var next Person
+		err = json.Unmarshal(persBytes, &next)
+		if err != nil {
+			fmt.Println("Error unmarshalling person " + person.MergedInto)
+			return person, errors.New("Error retrieving person " + person.MergedInto)
+		}
+		person = next
+	}
+	return person, nil
+}
+
+// followCompanyRedirect returns the company a merged company was merged into
+func followCompanyRedirect(stub *shim.ChaincodeStub, company Company) (Company, error) {
+	for i := 0; company.MergedInto != ""; i++ {
+		if i == maxRedirects {
+			return company, errors.New("Too many redirects from company " + company.ID)
+		}
+		compBytes, err := stub.GetState(companyPrefix + company.MergedInto)
+		if err != nil || compBytes == nil {
+			return company, errors.New("Company " + company.ID + " was merged into missing company " + company.MergedInto)
+		}
+		var next Company
+		err = json.Unmarshal(compBytes, &next)
+		if err != nil {
+			fmt.Println("Error unmarshalling company " + company.MergedInto)
+			return company, errors.New("Error retrieving company " + company.MergedInto)
+		}
+		company = next
+	}
+	return company, nil
+}
+
+// getRecord reads a person or company without following redirects
+func getRecord(stub *shim.ChaincodeStub, subjectType string, subjectID string, record interface{}) error {
+	key := personPrefix + subjectID
+	if subjectType == ownerTypeCompany {
+		key = companyPrefix + subjectID
+	}
+
+	recordBytes, err := stub.GetState(key)
+	if err != nil || recordBytes == nil {
+		return errors.New("No " + subjectType + " record found for " + subjectID)
+	}
+	err = json.Unmarshal(recordBytes, record)
+	if err != nil {
+		fmt.Println("Error unmarshalling " + key)
+		return errors.New("Error retrieving " + subjectType + " " + subjectID)
+	}
+	return nil
+}
+
+func putRecord(stub *shim.ChaincodeStub, key string, record interface{}) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		fmt.Println("Error marshalling " + key)
+		return errors.New("Error writing " + key)
+	}
+	err = stub.PutState(key, recordBytes)
+	if err != nil {
+		fmt.Println("Error writing " + key)
+		return errors.New("Error writing " + key)
+	}
+	return nil
+}
+
+// mergeUrlLinks adds the links of the duplicate the survivor doesn't have
+func mergeUrlLinks(survivor []UrlLink, duplicate []UrlLink) []UrlLink {
+	for _, link := range duplicate {
+		canonical := link.Url
+		if c, err := parseUrlLink(link); err == nil {
+			canonical = c
+		}
+		if linkIndex(survivor, canonical) < 0 {
+			survivor = append(survivor, link)
+		}
+	}
+	return survivor
+}
+
+// moveHeldRelationships makes the survivor the holder of every relationship
+// the duplicate holds, and returns the moved relationships
+func moveHeldRelationships(stub *shim.ChaincodeStub, holderType string, survivorID string, duplicateID string) ([]Relationship, error) {
+	rels, err := GetHolderRelationships(stub, holderType, duplicateID, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range rels {
+		rel.HolderID = survivorID
+		err = putRelationship(stub, rel)
+		if err != nil {
+			return nil, err
+		}
+		err = appendKey(stub, holderRelKeys(holderType, survivorID), rel.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rels, putKeyList(stub, holderRelKeys(holderType, duplicateID), []string{})
+}
+
+// moveCompanyRelationships moves the relationships held in the duplicate
+// company to the survivor, and returns the moved relationships
+func moveCompanyRelationships(stub *shim.ChaincodeStub, survivorID string, duplicateID string) ([]Relationship, error) {
+	rels, err := GetCompanyRelationships(stub, duplicateID, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range rels {
+		rel.CompanyID = survivorID
+		err = putRelationship(stub, rel)
+		if err != nil {
+			return nil, err
+		}
+		err = appendKey(stub, companyRelKeysPrefix+survivorID, rel.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rels, putKeyList(stub, companyRelKeysPrefix+duplicateID, []string{})
+}
+
+// checkMovedHoldings runs the ownership checks of a new shareholding on each
+// moved shareholding, as it is stored once the merge has moved them all
+func checkMovedHoldings(stub *shim.ChaincodeStub, moved []Relationship) error {
+	for _, m := range moved {
+		rel, err := GetRelationship(stub, m.ID)
+		if err != nil {
+			return err
+		}
+		if rel.Role != roleShareholder || (rel.HolderType == ownerTypeCompany && rel.HolderID == rel.CompanyID) {
+			// Holdings in itself were ended by endSelfHoldings
+			continue
+		}
+		err = checkOwnership(stub, rel)
+		if err != nil {
+			return errors.New("Can't merge, moving relationship " + rel.ID + " fails: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// moveConsents gives the survivor the unrevoked consents of the duplicate for
+// relying parties the survivor has no consent record for. Every consent of
+// the duplicate is revoked.
+func moveConsents(stub *shim.ChaincodeStub, survivorID string, duplicateID string, actor string, date string) error {
+	events, err := GetConsentLog(stub, duplicateID)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, event := range events {
+		if seen[event.RelyingParty] {
+			continue
+		}
+		seen[event.RelyingParty] = true
+
+		consent, found, err := GetConsent(stub, duplicateID, event.RelyingParty)
+		if err != nil {
+			return err
+		}
+		if !found || consent.RevokedAt != "" {
+			continue
+		}
+		_, held, err := GetConsent(stub, survivorID, event.RelyingParty)
+		if err != nil {
+			return err
+		}
+		if !held {
+			consent.PersonID = survivorID
+			err = putConsent(stub, consent)
+			if err != nil {
+				return err
+			}
+			err = logConsentEvent(stub, ConsentEvent{Action: "grant", PersonID: survivorID, RelyingParty: consent.RelyingParty,
+				Fields: consent.Fields, Expiry: consent.Expiry, Actor: actor, Date: date})
+			if err != nil {
+				return err
+			}
+		}
+
+		err = stub.DelState(consentKey(duplicateID, event.RelyingParty))
+		if err != nil {
+			fmt.Println("Error deleting consent of " + duplicateID + " for " + event.RelyingParty)
+			return errors.New("Error moving consents of " + duplicateID)
+		}
+		err = logConsentEvent(stub, ConsentEvent{Action: "revoke", PersonID: duplicateID, RelyingParty: event.RelyingParty,
+			Actor: actor, Date: date})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveDID gives the survivor the DID of the duplicate, with its keys, when
+// the survivor has no DID of its own. Otherwise the DID of the duplicate is
+// deactivated.
+func moveDID(stub *shim.ChaincodeStub, subjectType string, survivorID string, duplicateID string, date string) error {
+	record, err := getDIDRecord(stub, didFor(subjectType, duplicateID))
+	if err != nil {
+		// The duplicate has no DID
+		return nil
+	}
+	record.Updated = date
+
+	if _, err := getDIDRecord(stub, didFor(subjectType, survivorID)); err == nil {
+		record.Deactivated = true
+		return putDIDRecord(stub, record)
+	}
+
+	oldDID := record.DID
+	record.DID = didFor(subjectType, survivorID)
+	record.SubjectID = survivorID
+	for i := range record.Keys {
+		record.Keys[i].ID = record.DID + "#key-" + strconv.Itoa(i+1)
+	}
+	err = putDIDRecord(stub, record)
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(didPrefix + oldDID)
+	if err != nil {
+		fmt.Println("Error deleting DID " + oldDID)
+		return errors.New("Error moving DID " + oldDID)
+	}
+	return nil
+}
+
+// endSelfHoldings ends the holdings a merged company now has in itself
+func endSelfHoldings(stub *shim.ChaincodeStub, companyID string, date string) error {
+	rels, err := GetCompanyRelationships(stub, companyID, false)
+	if err != nil {
+		return err
+	}
+	for _, rel := range rels {
+		if rel.HolderType != ownerTypeCompany || rel.HolderID != companyID || rel.EndDate != "" {
+			continue
+		}
+		// A holding that hasn't started yet ends as it starts
+		rel.EndDate = date
+		if start, end, err := relationshipPeriod(rel); err == nil && !start.Before(end) {
+			rel.EndDate = rel.StartDate
+		}
+		rel.EndReason = "holder merged into the company"
+		err = putRelationship(stub, rel)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeArgs checks the arguments shared by mergePersons and mergeCompanies
+// and returns the admin merging the records
+func mergeArgs(stub *shim.ChaincodeStub, args []string) (string, error) {
+
+	/*		0				1				2
+			"survivorId"	"duplicateId"	"reason"
+	*/
+	if len(args) != 3 {
+		fmt.Println("error invalid arguments")
+		return "", errors.New("Incorrect number of arguments. Expecting survivor ID, duplicate ID and reason")
+	}
+	if args[0] == args[1] {
+		return "", errors.New("Can't merge a record into itself")
+	}
+	return checkAdmin(stub)
+}
+
+func (t *SimpleChaincode) mergePersons(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	actor, err := mergeArgs(stub, args)
+	if err != nil {
+		return nil, err
+	}
+
+	var survivor, duplicate Person
+	err = getRecord(stub, ownerTypePerson, args[0], &survivor)
+	if err != nil {
+		return nil, err
+	}
+	err = getRecord(stub, ownerTypePerson, args[1], &duplicate)
+	if err != nil {
+		return nil, err
+	}
+	if survivor.Status == statusErased || survivor.Status == statusMerged {
+		return nil, errors.New("Can't merge into person " + survivor.ID + ", it is " + survivor.Status)
+	}
+	change, err := newStatusChange(stub, mergeTransition, duplicate.Status, args[2], actor)
+	if err != nil {
+		fmt.Println("Error merging person " + duplicate.ID)
+		return nil, err
+	}
+
+	// Survivor takes over the links, relationships, consents and DID. The
+	// persons merged into the duplicate are now merged into the survivor.
+	survivor.UrlLinks = mergeUrlLinks(survivor.UrlLinks, duplicate.UrlLinks)
+	survivor.MergedFrom = append(append(survivor.MergedFrom, duplicate.MergedFrom...), duplicate.ID)
+	_, err = moveHeldRelationships(stub, ownerTypePerson, survivor.ID, duplicate.ID)
+	if err != nil {
+		return nil, err
+	}
+	err = moveConsents(stub, survivor.ID, duplicate.ID, actor, change.Date)
+	if err != nil {
+		return nil, err
+	}
+	err = moveDID(stub, ownerTypePerson, survivor.ID, duplicate.ID, change.Date)
+	if err != nil {
+		return nil, err
+	}
+	err = removeIndexes(stub, ownerTypePerson, duplicate.ID, personIndexValues(duplicate))
+	if err != nil {
+		return nil, err
+	}
+	if survivor.EnrollmentID == "" {
+		survivor.EnrollmentID = duplicate.EnrollmentID
+	}
+	if survivor.Photo == nil {
+		survivor.Photo = duplicate.Photo
+	} else {
+		err = countPhotoRef(stub, duplicate.Photo, -1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tombstone := Person{
+		ID:            duplicate.ID,
+		Registrator:   duplicate.Registrator,
+		RegisterDate:  duplicate.RegisterDate,
+		Status:        change.To,
+		StatusHistory: append(duplicate.StatusHistory, change),
+		MergedInto:    survivor.ID,
+	}
+
+	err = putRecord(stub, personPrefix+survivor.ID, &survivor)
+	if err != nil {
+		return nil, err
+	}
+	err = putRecord(stub, personPrefix+tombstone.ID, &tombstone)
+	if err != nil {
+		return nil, err
+	}
+	err = removeKey(stub, personKeysID, personPrefix+tombstone.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Merged person " + duplicate.ID + " into " + survivor.ID)
+	return nil, nil
+}
+
+func (t *SimpleChaincode) mergeCompanies(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	actor, err := mergeArgs(stub, args)
+	if err != nil {
+		return nil, err
+	}
+
+	var survivor, duplicate Company
+	err = getRecord(stub, ownerTypeCompany, args[0], &survivor)
+	if err != nil {
+		return nil, err
+	}
+	err = getRecord(stub, ownerTypeCompany, args[1], &duplicate)
+	if err != nil {
+		return nil, err
+	}
+	if survivor.Status == statusMerged {
+		return nil, errors.New("Can't merge into company " + survivor.ID + ", it is " + survivor.Status)
+	}
+	change, err := newStatusChange(stub, mergeTransition, duplicate.Status, args[2], actor)
+	if err != nil {
+		fmt.Println("Error merging company " + duplicate.ID)
+		return nil, err
+	}
+
+	// Survivor takes over the links, relationships and DID. The companies
+	// merged into the duplicate are now merged into the survivor.
+	survivor.UrlLinks = mergeUrlLinks(survivor.UrlLinks, duplicate.UrlLinks)
+	survivor.MergedFrom = append(append(survivor.MergedFrom, duplicate.MergedFrom...), duplicate.ID)
+	if survivor.EnrollmentID == "" {
+		survivor.EnrollmentID = duplicate.EnrollmentID
+	}
+	held, err := moveHeldRelationships(stub, ownerTypeCompany, survivor.ID, duplicate.ID)
+	if err != nil {
+		return nil, err
+	}
+	owned, err := moveCompanyRelationships(stub, survivor.ID, duplicate.ID)
+	if err != nil {
+		return nil, err
+	}
+	err = endSelfHoldings(stub, survivor.ID, change.Date)
+	if err != nil {
+		return nil, err
+	}
+	err = checkMovedHoldings(stub, append(held, owned...))
+	if err != nil {
+		return nil, err
+	}
+	err = moveDID(stub, ownerTypeCompany, survivor.ID, duplicate.ID, change.Date)
+	if err != nil {
+		return nil, err
+	}
+	err = removeIndexes(stub, ownerTypeCompany, duplicate.ID, companyIndexValues(duplicate))
+	if err != nil {
+		return nil, err
+	}
+
+	tombstone := Company{
+		ID:            duplicate.ID,
+		Name:          duplicate.Name,
+		Registrator:   duplicate.Registrator,
+		RegisterDate:  duplicate.RegisterDate,
+		Status:        change.To,
+		StatusHistory: append(duplicate.StatusHistory, change),
+		MergedInto:    survivor.ID,
+	}
+
+	err = putRecord(stub, companyPrefix+survivor.ID, &survivor)
+	if err != nil {
+		return nil, err
+	}
+	err = putRecord(stub, companyPrefix+tombstone.ID, &tombstone)
+	if err != nil {
+		return nil, err
+	}
+	err = removeKey(stub, companyKeysID, companyPrefix+tombstone.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Merged company " + duplicate.ID + " into " + survivor.ID)
+	return nil, nil
+}
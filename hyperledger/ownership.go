@@ -0,0 +1,276 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: ownership graph between companies
+
+An ownership edge is a shareholder relationship whose holder is a company.
+A new shareholding is rejected when, at any time during it, the shareholdings
+of the company would add up to more than 100%, or when the holder is itself
+owned, directly or through other companies, by the company it buys into.
+
+GetCorporateTree walks the edges from a company down to its subsidiaries, or
+up to its holding companies, as they are at the date of the transaction.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Depth GetCorporateTree walks to when none is given
+var defaultTreeDepth = 3
+
+// Directions GetCorporateTree walks in
+const (
+	treeDown = "down"
+	treeUp   = "up"
+)
+
+// CorporateTree is a company and the companies it owns, or is owned by.
+// Shareholding is the percentage held along the edge to the parent node.
+type CorporateTree struct {
+	CompanyID      string          `json:"companyId"`
+	Name           string          `json:"name"`
+	RelationshipID string          `json:"relationshipId,omitempty"`
+	Shareholding   float64         `json:"shareholding,omitempty"`
+	Children       []CorporateTree `json:"children,omitempty"`
+	Truncated      bool            `json:"truncated,omitempty"`
+}
+
+// relationshipPeriod returns when a relationship starts and ends. A zero end
+// means it hasn't ended.
+func relationshipPeriod(rel Relationship) (time.Time, time.Time, error) {
+	var end time.Time
+
+	start, err := parseDate(rel.StartDate)
+	if err != nil {
+		return start, end, err
+	}
+	if rel.EndDate != "" {
+		end, err = parseDate(rel.EndDate)
+	}
+	return start, end, err
+}
+
+// overlaps reports whether two relationships are in force at the same time
+func overlaps(a Relationship, b Relationship) bool {
+	aStart, aEnd, err := relationshipPeriod(a)
+	if err != nil {
+		return false
+	}
+	bStart, bEnd, err := relationshipPeriod(b)
+	if err != nil {
+		return false
+	}
+	return (aEnd.IsZero() || bStart.Before(aEnd)) && (bEnd.IsZero() || aStart.Before(bEnd))
+}
+
+// inForceAt reports whether a relationship is in force at t
+func inForceAt(rel Relationship, t time.Time) bool {
+	start, end, err := relationshipPeriod(rel)
+	return err == nil && !start.After(t) && (end.IsZero() || t.Before(end))
+}
+
+// checkOwnership rejects a new or moved shareholding that would take the
+// holdings of the company over 100% or create an ownership cycle
+func checkOwnership(stub *shim.ChaincodeStub, rel Relationship) error {
+	rels, err := GetCompanyRelationships(stub, rel.CompanyID, false)
+	if err != nil {
+		return err
+	}
+	err = checkShareholdingTotal(rel, rels)
+	if err != nil {
+		return err
+	}
+	if rel.HolderType != ownerTypeCompany {
+		return nil
+	}
+	return checkOwnershipCycle(rel, func(companyID string) ([]Relationship, error) {
+		return GetCompanyRelationships(stub, companyID, false)
+	})
+}
+
+// checkShareholdingTotal rejects a shareholding that would take the holdings
+// of the company over 100% at any time, given the relationships it already has
+func checkShareholdingTotal(rel Relationship, rels []Relationship) error {
+	// Holdings only change when a shareholding starts, so it is enough to add
+	// them up at the start of every shareholding that overlaps the new one
+	var shareholdings []Relationship
+	for _, r := range rels {
+		// A stored shareholding being checked again isn't counted twice
+		if r.ID != rel.ID && r.Role == roleShareholder && overlaps(r, rel) {
+			shareholdings = append(shareholdings, r)
+		}
+	}
+	for _, point := range append(shareholdings, rel) {
+		t, _, err := relationshipPeriod(point)
+		if err != nil || !inForceAt(rel, t) {
+			continue
+		}
+		total := rel.Shareholding
+		for _, r := range shareholdings {
+			if inForceAt(r, t) {
+				total += r.Shareholding
+			}
+		}
+		if total > 100 {
+			return errors.New("Shareholdings of company " + rel.CompanyID + " would add up to " +
+				strconv.FormatFloat(total, 'f', -1, 64) + "% on " + t.Format("2006-01-02"))
+		}
+	}
+	return nil
+}
+
+// checkOwnershipCycle rejects a shareholding of one company in another that
+// would close an ownership cycle. holdersOf returns the relationships of a
+// company.
+func checkOwnershipCycle(rel Relationship, holdersOf func(companyID string) ([]Relationship, error)) error {
+	// Walk up from the holder through its company shareholders; reaching the
+	// company it buys into means the new edge closes a cycle
+	visited := map[string]bool{}
+	pending := []string{rel.HolderID}
+	for len(pending) > 0 {
+		companyID := pending[0]
+		pending = pending[1:]
+		if companyID == rel.CompanyID {
+			return errors.New("Company " + rel.HolderID + " is already owned by " + rel.CompanyID + ", ownership can't be circular")
+		}
+		if visited[companyID] {
+			continue
+		}
+		visited[companyID] = true
+
+		holders, err := holdersOf(companyID)
+		if err != nil {
+			return err
+		}
+		for _, h := range holders {
+			if h.HolderType == ownerTypeCompany && h.Role == roleShareholder && overlaps(h, rel) {
+				pending = append(pending, h.HolderID)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *SimpleChaincode) registerCompanyOwnership(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	/*		0					1					2				3
+			"holdingCompanyId"	"subsidiaryId"		"shareholding"	"startDate"
+	*/
+	if len(args) != 4 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting holding company ID, subsidiary ID, shareholding and start date")
+	}
+
+	shareholding, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		return nil, errors.New("Shareholding must be a percentage")
+	}
+
+	relID, err := addRelationship(stub, Relationship{
+		HolderType:   ownerTypeCompany,
+		HolderID:     args[0],
+		CompanyID:    args[1],
+		Role:         roleShareholder,
+		Shareholding: shareholding,
+		StartDate:    args[3],
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(relID), nil
+}
+
+// GetCorporateTree returns the subsidiaries (direction down) or holding
+// companies (direction up) of a company, depth levels deep
+func GetCorporateTree(stub *shim.ChaincodeStub, companyID string, direction string, sDepth string) (CorporateTree, error) {
+	var tree CorporateTree
+
+	if direction == "" {
+		direction = treeDown
+	}
+	if direction != treeDown && direction != treeUp {
+		return tree, errors.New("Unknown direction " + direction + ", expecting down or up")
+	}
+	depth := defaultTreeDepth
+	if sDepth != "" {
+		var err error
+		depth, err = strconv.Atoi(sDepth)
+		if err != nil || depth < 1 || depth > maxOwnershipDepth {
+			return tree, errors.New("Depth must be a whole number between 1 and " + strconv.Itoa(maxOwnershipDepth))
+		}
+	}
+
+	company, err := GetCompany(companyID, stub)
+	if err != nil {
+		return tree, errors.New("Company " + companyID + " not found")
+	}
+	tree = CorporateTree{CompanyID: company.ID, Name: company.Name}
+
+	err = growCorporateTree(stub, &tree, direction, depth, map[string]bool{company.ID: true})
+	return tree, err
+}
+
+func growCorporateTree(stub *shim.ChaincodeStub, node *CorporateTree, direction string, depth int, onPath map[string]bool) error {
+	var rels []Relationship
+	var err error
+
+	if direction == treeDown {
+		rels, err = GetHolderRelationships(stub, ownerTypeCompany, node.CompanyID, true)
+	} else {
+		rels, err = GetCompanyRelationships(stub, node.CompanyID, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, rel := range rels {
+		if rel.Role != roleShareholder || rel.HolderType != ownerTypeCompany {
+			continue
+		}
+		if depth == 0 {
+			node.Truncated = true
+			return nil
+		}
+
+		childID := rel.CompanyID
+		if direction == treeUp {
+			childID = rel.HolderID
+		}
+		child := CorporateTree{CompanyID: childID, RelationshipID: rel.ID, Shareholding: rel.Shareholding}
+		if company, err := GetCompany(childID, stub); err == nil {
+			child.Name = company.Name
+		}
+
+		// Writes reject cycles, but don't loop on any recorded before that
+		if !onPath[childID] {
+			onPath[childID] = true
+			err = growCorporateTree(stub, &child, direction, depth-1, onPath)
+			delete(onPath, childID)
+			if err != nil {
+				return err
+			}
+		}
+		node.Children = append(node.Children, child)
+	}
+	return nil
+}
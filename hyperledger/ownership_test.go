@@ -0,0 +1,116 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func shareholding(id string, holderType string, holderID string, companyID string, percent float64, start string, end string) Relationship {
+	return Relationship{ID: id, HolderType: holderType, HolderID: holderID, CompanyID: companyID,
+		Role: roleShareholder, Shareholding: percent, StartDate: start, EndDate: end}
+}
+
+func TestOverlaps(t *testing.T) {
+	tests := []struct {
+		aStart, aEnd, bStart, bEnd string
+		want                       bool
+	}{
+		{"2016-01-01", "", "2017-01-01", "", true},
+		{"2016-01-01", "2017-01-01", "2017-01-01", "", false},
+		{"2016-01-01", "2017-01-02", "2017-01-01", "", true},
+		{"2018-01-01", "", "2016-01-01", "2017-01-01", false},
+		{"2016-01-01", "", "bad", "", false},
+	}
+	for _, tt := range tests {
+		a := shareholding("a", ownerTypePerson, "p", "c", 10, tt.aStart, tt.aEnd)
+		b := shareholding("b", ownerTypePerson, "q", "c", 10, tt.bStart, tt.bEnd)
+		if got := overlaps(a, b); got != tt.want {
+			t.Errorf("overlaps(%s..%s, %s..%s) = %v, want %v", tt.aStart, tt.aEnd, tt.bStart, tt.bEnd, got, tt.want)
+		}
+	}
+}
+
+func TestCheckShareholdingTotal(t *testing.T) {
+	sixty := shareholding("r1", ownerTypePerson, "p", "acme", 60, "2016-01-01", "")
+	tests := []struct {
+		name    string
+		rel     Relationship
+		rels    []Relationship
+		wantErr bool
+	}{
+		{"first holding", shareholding("r2", ownerTypePerson, "q", "acme", 100, "2016-01-01", ""), nil, false},
+		{"up to 100", shareholding("r2", ownerTypePerson, "q", "acme", 40, "2016-06-01", ""), []Relationship{sixty}, false},
+		{"over 100", shareholding("r2", ownerTypePerson, "q", "acme", 50, "2016-06-01", ""), []Relationship{sixty}, true},
+		{"over 100 before the other starts", shareholding("r2", ownerTypePerson, "q", "acme", 50, "2015-01-01", ""), []Relationship{sixty}, true},
+		{"after the other ended", shareholding("r2", ownerTypePerson, "q", "acme", 50, "2017-01-01", ""),
+			[]Relationship{shareholding("r1", ownerTypePerson, "p", "acme", 60, "2016-01-01", "2017-01-01")}, false},
+		{"ended before the other starts", shareholding("r2", ownerTypePerson, "q", "acme", 50, "2015-01-01", "2016-01-01"), []Relationship{sixty}, false},
+		{"stored holding checked again", shareholding("r1", ownerTypePerson, "p", "acme", 80, "2016-01-01", ""), []Relationship{sixty}, false},
+		{"other roles don't count", shareholding("r2", ownerTypePerson, "q", "acme", 50, "2016-01-01", ""),
+			[]Relationship{{ID: "r3", HolderType: ownerTypePerson, HolderID: "d", CompanyID: "acme", Role: "director", Shareholding: 60, StartDate: "2016-01-01"}}, false},
+	}
+	for _, tt := range tests {
+		err := checkShareholdingTotal(tt.rel, tt.rels)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkShareholdingTotal = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckOwnershipCycle(t *testing.T) {
+	// top owns hold, which owns acme; old owned acme until 2015
+	stored := []Relationship{
+		shareholding("r1", ownerTypeCompany, "top", "hold", 60, "2016-01-01", ""),
+		shareholding("r2", ownerTypeCompany, "hold", "acme", 50, "2016-01-01", ""),
+		shareholding("r3", ownerTypeCompany, "old", "acme", 10, "2010-01-01", "2015-01-01"),
+		shareholding("r4", ownerTypePerson, "top", "acme", 10, "2016-01-01", ""),
+	}
+	holdersOf := func(companyID string) ([]Relationship, error) {
+		var rels []Relationship
+		for _, r := range stored {
+			if r.CompanyID == companyID {
+				rels = append(rels, r)
+			}
+		}
+		return rels, nil
+	}
+
+	tests := []struct {
+		name    string
+		rel     Relationship
+		wantErr bool
+	}{
+		{"closes a cycle", shareholding("n", ownerTypeCompany, "acme", "top", 10, "2016-01-01", ""), true},
+		{"closes a short cycle", shareholding("n", ownerTypeCompany, "acme", "hold", 10, "2016-01-01", ""), true},
+		{"holds itself", shareholding("n", ownerTypeCompany, "acme", "acme", 10, "2016-01-01", ""), true},
+		{"down the tree", shareholding("n", ownerTypeCompany, "top", "acme", 10, "2016-01-01", ""), false},
+		{"unrelated", shareholding("n", ownerTypeCompany, "acme", "other", 10, "2016-01-01", ""), false},
+		{"after the edge ended", shareholding("n", ownerTypeCompany, "acme", "old", 10, "2016-01-01", ""), false},
+		{"while the edge was in force", shareholding("n", ownerTypeCompany, "acme", "old", 10, "2012-01-01", ""), true},
+	}
+	for _, tt := range tests {
+		err := checkOwnershipCycle(tt.rel, holdersOf)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkOwnershipCycle = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	failing := func(string) ([]Relationship, error) { return nil, errors.New("unavailable") }
+	if err := checkOwnershipCycle(shareholding("n", ownerTypeCompany, "acme", "top", 10, "2016-01-01", ""), failing); err == nil {
+		t.Errorf("checkOwnershipCycle should return the lookup error")
+	}
+}
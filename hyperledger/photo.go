@@ -0,0 +1,281 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: person photos kept off the ledger
+
+A person record holds only the digest, MIME type and size of its photo. The
+image itself lives in photoStore, which the chaincode only reads. The client
+puts the image in the store and registers the person with a photo reference;
+registerPerson checks the store holds that image and refuses an inline
+dataPhoto, whose bytes would stay on the ledger in the transaction. Whatever
+the peer's store, every peer so writes the same state or fails the same way.
+CheckPersonPhoto tells whether a given image is the registered photo.
+
+Inline photos of persons registered before photos were kept off the ledger
+stay on the record until an admin puts the image in the store and calls
+offloadPersonPhoto, which replaces it with a reference.
+
+Blobs are shared by every person with the same photo, so the ledger counts
+the persons referring to each digest. Invokes never delete from the store: a
+blob nobody refers to any more, or one uploaded for a registration that then
+failed, is listed by GetUnreferencedPhotos for an off-chain sweep.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Store holding person photos, nil when none is configured
+var photoStore BlobStore = blobStoreFromEnv()
+
+var maxPhotoSize = 5 * 1024 * 1024
+
+// Number of persons referring to a photo, by digest
+var photoRefPrefix = "photoref:"
+
+// PhotoRef is the on-ledger reference to a photo in the blob store
+type PhotoRef struct {
+	Digest   string `json:"digest"`
+	MimeType string `json:"mimeType"`
+	Size     int    `json:"size"`
+}
+
+// PhotoCheck is the result of CheckPersonPhoto
+type PhotoCheck struct {
+	PersonID       string `json:"personId"`
+	Digest         string `json:"digest"`
+	SuppliedDigest string `json:"suppliedDigest"`
+	Match          bool   `json:"match"`
+	Stored         bool   `json:"stored"`
+}
+
+// decodePhoto reads an image given as a data URI or as plain base64
+func decodePhoto(s string) ([]byte, string, error) {
+	var mimeType string
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "data:") {
+		comma := strings.Index(s, ",")
+		if comma < 0 || !strings.HasSuffix(s[:comma], ";base64") {
+			return nil, "", errors.New("Photo data URI must be base64 encoded")
+		}
+		mimeType = strings.TrimSuffix(strings.TrimPrefix(s[:comma], "data:"), ";base64")
+		s = s[comma+1:]
+	}
+
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, "", errors.New("Photo is not valid base64")
+	}
+	if len(data) == 0 || len(data) > maxPhotoSize {
+		return nil, "", errors.New("Photo must be between 1 byte and " + strconv.Itoa(maxPhotoSize) + " bytes")
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		return nil, "", errors.New("Photo must be an image, not " + mimeType)
+	}
+	return data, mimeType, nil
+}
+
+// photoRefCount returns how many persons refer to a photo
+func photoRefCount(stub *shim.ChaincodeStub, digest string) (int, error) {
+	countBytes, err := stub.GetState(photoRefPrefix + digest)
+	if err != nil {
+		fmt.Println("Error retrieving references to photo " + digest)
+		return 0, errors.New("Error retrieving references to photo " + digest)
+	}
+	if countBytes == nil {
+		return 0, nil
+	}
+	count, err := strconv.Atoi(string(countBytes))
+	if err != nil {
+		return 0, errors.New("Invalid reference count of photo " + digest)
+	}
+	return count, nil
+}
+
+// countPhotoRef adds delta to the references to a photo
+func countPhotoRef(stub *shim.ChaincodeStub, photo *PhotoRef, delta int) error {
+	if photo == nil {
+		return nil
+	}
+	count, err := photoRefCount(stub, photo.Digest)
+	if err != nil {
+		return err
+	}
+	count += delta
+	if count <= 0 {
+		err = stub.DelState(photoRefPrefix + photo.Digest)
+	} else {
+		err = stub.PutState(photoRefPrefix+photo.Digest, []byte(strconv.Itoa(count)))
+	}
+	if err != nil {
+		fmt.Println("Error writing references to photo " + photo.Digest)
+		return errors.New("Error writing references to photo " + photo.Digest)
+	}
+	return nil
+}
+
+// checkStoredPhoto checks that the photo store holds the image a photo
+// reference points to
+func checkStoredPhoto(photo *PhotoRef) error {
+	if photoStore == nil {
+		return errors.New("No photo store configured on this peer")
+	}
+	data, err := photoStore.Get(photo.Digest)
+	if err != nil {
+		return errors.New("Photo " + photo.Digest + " is not in the photo store")
+	}
+	if blobDigest(data) != photo.Digest || len(data) != photo.Size {
+		return errors.New("Photo " + photo.Digest + " in the photo store doesn't match its reference")
+	}
+	return nil
+}
+
+// preparePersonPhoto checks the photo reference a person is registered with
+// against the photo store. Inline photos are refused.
+func preparePersonPhoto(person *Person) error {
+	if person.DataPhoto != "" {
+		return errors.New("Inline photos are not accepted, put the photo in the photo store and register its reference")
+	}
+	if person.Photo == nil {
+		return nil
+	}
+	if !isBlobDigest(person.Photo.Digest) {
+		return errors.New("Invalid photo digest " + person.Photo.Digest)
+	}
+	if !strings.HasPrefix(person.Photo.MimeType, "image/") {
+		return errors.New("Photo must be an image, not " + person.Photo.MimeType)
+	}
+	if person.Photo.Size <= 0 || person.Photo.Size > maxPhotoSize {
+		return errors.New("Photo must be between 1 byte and " + strconv.Itoa(maxPhotoSize) + " bytes")
+	}
+	return checkStoredPhoto(person.Photo)
+}
+
+func (t *SimpleChaincode) offloadPersonPhoto(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	/*		0
+			person ID
+	*/
+	if len(args) != 1 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting person ID")
+	}
+	_, err := checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	person, err := GetPerson(args[0], stub)
+	if err != nil {
+		return nil, errors.New("Person " + args[0] + " not found")
+	}
+	if person.DataPhoto == "" {
+		return nil, errors.New("Person " + person.ID + " has no inline photo")
+	}
+	data, mimeType, err := decodePhoto(person.DataPhoto)
+	if err != nil {
+		return nil, err
+	}
+	photo := &PhotoRef{Digest: blobDigest(data), MimeType: mimeType, Size: len(data)}
+	err = checkStoredPhoto(photo)
+	if err != nil {
+		return nil, err
+	}
+
+	person.Photo = photo
+	person.DataPhoto = ""
+	err = putRecord(stub, personPrefix+person.ID, &person)
+	if err != nil {
+		return nil, err
+	}
+	err = countPhotoRef(stub, person.Photo, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Moved the photo of person " + person.ID + " to " + photo.Digest)
+	return nil, nil
+}
+
+// CheckPersonPhoto compares an image with the registered photo of a person,
+// and tells whether the photo store still holds the registered photo intact
+func CheckPersonPhoto(stub *shim.ChaincodeStub, personID string, image string) (PhotoCheck, error) {
+	var check PhotoCheck
+
+	person, err := GetPerson(personID, stub)
+	if err != nil {
+		return check, errors.New("Person " + personID + " not found")
+	}
+	visible, err := filterPersonByConsent(stub, person)
+	if err != nil {
+		return check, err
+	}
+	if person.Photo != nil && visible.Photo == nil {
+		return check, errors.New("No consent to check the photo of person " + personID)
+	}
+	if person.Photo == nil {
+		return check, errors.New("Person " + personID + " has no registered photo")
+	}
+	data, _, err := decodePhoto(image)
+	if err != nil {
+		return check, err
+	}
+
+	check.PersonID = visible.ID
+	check.Digest = person.Photo.Digest
+	check.SuppliedDigest = blobDigest(data)
+	check.Match = check.SuppliedDigest == check.Digest && len(data) == person.Photo.Size
+	if photoStore != nil {
+		_, err = photoStore.Get(check.Digest)
+		check.Stored = err == nil
+	}
+	return check, nil
+}
+
+// GetUnreferencedPhotos lists the blobs in the photo store no person refers
+// to, for an off-chain sweep to delete
+func GetUnreferencedPhotos(stub *shim.ChaincodeStub) ([]string, error) {
+	if photoStore == nil {
+		return nil, errors.New("No photo store configured")
+	}
+	digests, err := photoStore.List()
+	if err != nil {
+		return nil, err
+	}
+
+	unreferenced := []string{}
+	for _, digest := range digests {
+		count, err := photoRefCount(stub, digest)
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			unreferenced = append(unreferenced, digest)
+		}
+	}
+	return unreferenced, nil
+}
@@ -0,0 +1,86 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: predicate queries that answer yes or no without disclosing the claim
+
+The answer still tells something about the claim, so the caller needs the
+same consent to the claim as to read it, see consent.go.
+*/
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// AgePredicate is the result of IsPersonOlderThan. It deliberately holds no
+// part of the birth date.
+type AgePredicate struct {
+	PersonID    string `json:"personId"`
+	Years       int    `json:"years"`
+	Result      bool   `json:"result"`
+	EvaluatedAt string `json:"evaluatedAt"`
+}
+
+// IsPersonOlderThan tells whether an active person had turned the given age
+// by the date of the transaction
+func IsPersonOlderThan(stub *shim.ChaincodeStub, personID string, sYears string) (AgePredicate, error) {
+	var predicate AgePredicate
+
+	years, err := strconv.Atoi(sYears)
+	if err != nil || years < 0 || years > 150 {
+		return predicate, errors.New("Years must be a whole number between 0 and 150")
+	}
+
+	person, err := GetPerson(personID, stub)
+	if err != nil {
+		return predicate, errors.New("Person " + personID + " not found")
+	}
+	if effectiveStatus(person.Status) != statusActive {
+		return predicate, errors.New("Person " + personID + " is " + person.Status + ", only active persons can be checked")
+	}
+	visible, err := filterPersonByConsent(stub, person)
+	if err != nil {
+		return predicate, err
+	}
+	if visible.BirthDate == "" {
+		return predicate, errors.New("No consent to check the age of person " + personID)
+	}
+
+	birthDate, err := person.BirthDate.Time()
+	if err != nil {
+		return predicate, errors.New("Person " + personID + " has an invalid birth date")
+	}
+	birthDate = birthDate.Truncate(24 * time.Hour)
+
+	now, err := txTime(stub)
+	if err != nil {
+		return predicate, err
+	}
+	today := now.Truncate(24 * time.Hour)
+	if birthDate.After(today) {
+		return predicate, errors.New("Person " + personID + " has a birth date in the future")
+	}
+
+	predicate.PersonID = visible.ID
+	predicate.Years = years
+	predicate.Result = !birthDate.AddDate(years, 0, 0).After(today)
+	predicate.EvaluatedAt = today.Format("2006-01-02")
+	return predicate, nil
+}
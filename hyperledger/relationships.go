@@ -0,0 +1,486 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: relationships between persons and companies
+
+A relationship gives a holder a role in a company from a start date until it
+is ended. The holder is a person, or for shareholders also a company, which
+is how holding-company chains are recorded. Relationships are never deleted;
+ending one sets its end date. Only an admin or the registrator of the company
+can add or end its relationships.
+
+GetBeneficialOwners multiplies shareholdings down the holding-company chains
+to find every person's effective ownership of a company. Persons declared as
+beneficial owners of a company are included whatever their shareholding.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var relationshipPrefix = "rel:"
+
+// Lists of the relationships of a company, and of a person or company holder
+var companyRelKeysPrefix = "RelKeys:company:"
+var holderRelKeysPrefix = "RelKeys:holder:"
+
+// Roles of a holder in a company
+const (
+	roleDirector        = "director"
+	roleSecretary       = "secretary"
+	roleOfficeholder    = "officeholder"
+	roleShareholder     = "shareholder"
+	roleBeneficialOwner = "beneficial-owner"
+)
+
+var knownRoles = []string{roleDirector, roleSecretary, roleOfficeholder, roleShareholder, roleBeneficialOwner}
+
+// Ownership at or above which a person is a beneficial owner, in percent
+var defaultBeneficialOwnerThreshold = 25.0
+
+// Holding-company chains are not followed deeper than this
+var maxOwnershipDepth = 10
+
+// Relationship is the role of a person or company in a company
+type Relationship struct {
+	ID           string  `json:"id"`
+	HolderType   string  `json:"holderType"`
+	HolderID     string  `json:"holderId"`
+	CompanyID    string  `json:"companyId"`
+	Role         string  `json:"role"`
+	Shareholding float64 `json:"shareholding"`
+	StartDate    string  `json:"startDate"`
+	EndDate      string  `json:"endDate,omitempty"`
+	EndReason    string  `json:"endReason,omitempty"`
+}
+
+// BeneficialOwner is a person owning or declared to control a company.
+// Ownership is in percent and Chains lists the holders from the company down
+// to the person for each holding.
+type BeneficialOwner struct {
+	PersonID  string     `json:"personId"`
+	Ownership float64    `json:"ownership"`
+	Declared  bool       `json:"declared"`
+	Chains    [][]string `json:"chains"`
+}
+
+// BeneficialOwners is the result of GetBeneficialOwners
+type BeneficialOwners struct {
+	CompanyID string            `json:"companyId"`
+	Threshold float64           `json:"threshold"`
+	Owners    []BeneficialOwner `json:"owners"`
+}
+
+func isKnownRole(role string) bool {
+	for _, r := range knownRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// activeAt reports whether a relationship has started and not yet ended
+func (r Relationship) activeAt(now time.Time) bool {
+	start, err := parseDate(r.StartDate)
+	if err != nil || start.After(now) {
+		return false
+	}
+	if r.EndDate == "" {
+		return true
+	}
+	end, err := parseDate(r.EndDate)
+	return err == nil && end.After(now)
+}
+
+func holderRelKeys(holderType string, holderID string) string {
+	return holderRelKeysPrefix + holderType + ":" + holderID
+}
+
+func putRelationship(stub *shim.ChaincodeStub, rel Relationship) error {
+	relBytes, err := json.Marshal(&rel)
+	if err != nil {
+		fmt.Println("Error marshalling relationship")
+		return errors.New("Error marshalling relationship")
+	}
+	err = stub.PutState(rel.ID, relBytes)
+	if err != nil {
+		fmt.Println("Error writing relationship " + rel.ID)
+		return errors.New("Error writing relationship " + rel.ID)
+	}
+	return nil
+}
+
+// GetRelationship returns a relationship by its ID
+func GetRelationship(stub *shim.ChaincodeStub, relID string) (Relationship, error) {
+	var rel Relationship
+
+	relBytes, err := stub.GetState(relID)
+	if err != nil || relBytes == nil {
+		return rel, errors.New("Relationship " + relID + " not found")
+	}
+	err = json.Unmarshal(relBytes, &rel)
+	if err != nil {
+		fmt.Println("Error unmarshalling relationship " + relID)
+		return rel, errors.New("Error unmarshalling relationship " + relID)
+	}
+	return rel, nil
+}
+
+func getRelationships(stub *shim.ChaincodeStub, listKey string) ([]Relationship, error) {
+	var rels []Relationship
+
+	keys, err := getKeyList(stub, listKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		rel, err := GetRelationship(stub, key)
+		if err != nil {
+			return nil, err
+		}
+		rels = append(rels, rel)
+	}
+	return rels, nil
+}
+
+// GetCompanyRelationships returns the relationships held in a company, only
+// the current ones when activeOnly is set
+func GetCompanyRelationships(stub *shim.ChaincodeStub, companyID string, activeOnly bool) ([]Relationship, error) {
+	rels, err := getRelationships(stub, companyRelKeysPrefix+companyID)
+	if err != nil || !activeOnly {
+		return rels, err
+	}
+	return filterActiveRelationships(stub, rels)
+}
+
+// GetHolderRelationships returns the relationships a person or company holds
+// in other companies, only the current ones when activeOnly is set
+func GetHolderRelationships(stub *shim.ChaincodeStub, holderType string, holderID string, activeOnly bool) ([]Relationship, error) {
+	rels, err := getRelationships(stub, holderRelKeys(holderType, holderID))
+	if err != nil || !activeOnly {
+		return rels, err
+	}
+	return filterActiveRelationships(stub, rels)
+}
+
+func filterActiveRelationships(stub *shim.ChaincodeStub, rels []Relationship) ([]Relationship, error) {
+	var active []Relationship
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range rels {
+		if rel.activeAt(now) {
+			active = append(active, rel)
+		}
+	}
+	return active, nil
+}
+
+// checkRelationship validates a new relationship against the registry
+func checkRelationship(stub *shim.ChaincodeStub, rel Relationship) error {
+	if !isKnownRole(rel.Role) {
+		return errors.New("Unknown role " + rel.Role + ", expecting one of " + strings.Join(knownRoles, ", "))
+	}
+	if rel.Shareholding < 0 || rel.Shareholding > 100 {
+		return errors.New("Shareholding must be between 0 and 100 percent")
+	}
+	if rel.Role == roleShareholder && rel.Shareholding == 0 {
+		return errors.New("A shareholder must hold more than 0 percent")
+	}
+	if rel.Role != roleShareholder && rel.Shareholding != 0 {
+		return errors.New("Only a shareholder can have a shareholding")
+	}
+
+	if rel.HolderType == ownerTypePerson {
+		person, err := GetPerson(rel.HolderID, stub)
+		if err != nil {
+			return errors.New("Person " + rel.HolderID + " not found")
+		}
+		if person.Status == statusErased {
+			return errors.New("Person " + rel.HolderID + " has been erased")
+		}
+	} else if rel.HolderType == ownerTypeCompany {
+		if rel.Role != roleShareholder {
+			return errors.New("A company can only be a shareholder of another company")
+		}
+		if rel.HolderID == rel.CompanyID {
+			return errors.New("A company can't hold shares in itself")
+		}
+		_, err := GetCompany(rel.HolderID, stub)
+		if err != nil {
+			return errors.New("Company " + rel.HolderID + " not found")
+		}
+	} else {
+		return errors.New("Unknown holder type " + rel.HolderType + ", expecting person or company")
+	}
+
+	_, err := GetCompany(rel.CompanyID, stub)
+	if err != nil {
+		return errors.New("Company " + rel.CompanyID + " not found")
+	}
+
+	start, err := parseDate(rel.StartDate)
+	if err != nil {
+		return err
+	}
+	if rel.EndDate != "" {
+		end, err := parseDate(rel.EndDate)
+		if err != nil {
+			return err
+		}
+		if !end.After(start) {
+			return errors.New("Relationship must end after it starts")
+		}
+	}
+
+	if rel.Role == roleShareholder {
+		return checkOwnership(stub, rel)
+	}
+	return nil
+}
+
+// addRelationship checks the caller may act for the company, then checks and
+// stores a new relationship and returns its ID
+func addRelationship(stub *shim.ChaincodeStub, rel Relationship) (string, error) {
+	rel.EndReason = ""
+
+	_, err := checkSubjectAccess(stub, ownerTypeCompany, rel.CompanyID)
+	if err != nil {
+		return "", err
+	}
+
+	err = checkRelationship(stub, rel)
+	if err != nil {
+		fmt.Println("Invalid relationship of " + rel.HolderID + " in " + rel.CompanyID)
+		return "", err
+	}
+
+	keys, err := getKeyList(stub, companyRelKeysPrefix+rel.CompanyID)
+	if err != nil {
+		return "", err
+	}
+	rel.ID = relationshipPrefix + rel.CompanyID + ":" + strconv.Itoa(len(keys))
+
+	err = putRelationship(stub, rel)
+	if err != nil {
+		return "", err
+	}
+	err = putKeyList(stub, companyRelKeysPrefix+rel.CompanyID, append(keys, rel.ID))
+	if err != nil {
+		return "", err
+	}
+	err = appendKey(stub, holderRelKeys(rel.HolderType, rel.HolderID), rel.ID)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Println("Registered relationship " + rel.ID)
+	return rel.ID, nil
+}
+
+func (t *SimpleChaincode) registerRelationship(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	/*		0
+			json
+			{
+				"holderType": "person",
+				"holderId": "johnsmith",
+				"companyId": "acmeptyltd",
+				"role": "shareholder",
+				"shareholding": 40,
+				"startDate": "2016-07-01"
+			}
+	*/
+	if len(args) != 1 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting relationship record")
+	}
+
+	var rel Relationship
+	err := json.Unmarshal([]byte(args[0]), &rel)
+	if err != nil {
+		fmt.Println("error invalid relationship")
+		return nil, errors.New("Invalid relationship")
+	}
+
+	relID, err := addRelationship(stub, rel)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(relID), nil
+}
+
+func (t *SimpleChaincode) endRelationship(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	/*		0					1			2
+			"relationshipId"	"endDate"	"reason"
+	*/
+	if len(args) != 3 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting relationship ID, end date and reason")
+	}
+
+	rel, err := GetRelationship(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	_, err = checkSubjectAccess(stub, ownerTypeCompany, rel.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+	if rel.EndDate != "" {
+		return nil, errors.New("Relationship " + rel.ID + " has already ended")
+	}
+	if args[2] == "" {
+		return nil, errors.New("A reason is required to end a relationship")
+	}
+
+	start, err := parseDate(rel.StartDate)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseDate(args[1])
+	if err != nil {
+		return nil, err
+	}
+	if !end.After(start) {
+		return nil, errors.New("Relationship must end after it starts")
+	}
+
+	rel.EndDate = args[1]
+	rel.EndReason = args[2]
+	err = putRelationship(stub, rel)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Ended relationship " + rel.ID)
+	return nil, nil
+}
+
+// GetBeneficialOwners returns the persons owning at least threshold percent
+// of a company, directly or through holding companies, and the persons
+// declared as its beneficial owners
+func GetBeneficialOwners(stub *shim.ChaincodeStub, companyID string, sThreshold string) (BeneficialOwners, error) {
+	var result BeneficialOwners
+
+	threshold := defaultBeneficialOwnerThreshold
+	if sThreshold != "" {
+		var err error
+		threshold, err = strconv.ParseFloat(sThreshold, 64)
+		if err != nil || threshold < 0 || threshold > 100 {
+			return result, errors.New("Threshold must be a percentage between 0 and 100")
+		}
+	}
+
+	_, err := GetCompany(companyID, stub)
+	if err != nil {
+		return result, errors.New("Company " + companyID + " not found")
+	}
+
+	owners := map[string]*BeneficialOwner{}
+	var order []string
+	owner := func(personID string) *BeneficialOwner {
+		if _, ok := owners[personID]; !ok {
+			owners[personID] = &BeneficialOwner{PersonID: personID}
+			order = append(order, personID)
+		}
+		return owners[personID]
+	}
+
+	// Walk down the holders of the company, multiplying shareholdings
+	var walk func(companyID string, share float64, chain []string) error
+	walk = func(companyID string, share float64, chain []string) error {
+		if len(chain) > maxOwnershipDepth {
+			return nil
+		}
+		rels, err := GetCompanyRelationships(stub, companyID, true)
+		if err != nil {
+			return err
+		}
+		for _, rel := range rels {
+			if rel.Role != roleShareholder && rel.Role != roleBeneficialOwner {
+				continue
+			}
+			holderChain := append(append([]string{}, chain...), rel.HolderType+":"+rel.HolderID)
+			if rel.HolderType == ownerTypeCompany {
+				seen := false
+				for _, link := range chain {
+					if link == rel.HolderType+":"+rel.HolderID {
+						seen = true
+					}
+				}
+				if !seen {
+					err = walk(rel.HolderID, share*rel.Shareholding/100, holderChain)
+					if err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if rel.Role == roleBeneficialOwner {
+				// Only declarations made on the company itself count
+				if len(chain) == 1 {
+					owner(rel.HolderID).Declared = true
+				}
+				continue
+			}
+			o := owner(rel.HolderID)
+			o.Ownership += share * rel.Shareholding / 100
+			o.Chains = append(o.Chains, holderChain)
+		}
+		return nil
+	}
+	err = walk(companyID, 100, []string{ownerTypeCompany + ":" + companyID})
+	if err != nil {
+		return result, err
+	}
+
+	result.CompanyID = companyID
+	result.Threshold = threshold
+	for _, personID := range order {
+		o := owners[personID]
+		if o.Declared || o.Ownership >= threshold {
+			// Person IDs are derived from names, which need consent
+			visibleID, err := visiblePersonID(stub, personID)
+			if err != nil {
+				return result, err
+			}
+			o.PersonID = visibleID
+			for _, chain := range o.Chains {
+				chain[len(chain)-1] = ownerTypePerson + ":" + visibleID
+			}
+			result.Owners = append(result.Owners, *o)
+		}
+	}
+	return result, nil
+}
+
+// activeOnlyArg reads the optional "active" flag of the relationship queries
+func activeOnlyArg(args []string, index int) bool {
+	return len(args) > index && args[index] == "active"
+}
@@ -0,0 +1,337 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: filtered search over persons and companies
+
+The Search query takes a json SearchQuery. Every predicate must hold for a
+record to match. eq and prefix compare text ignoring case and surrounding
+spaces; range compares dates, with both ends included and a plain yyyy-mm-dd
+end covering its whole day. Matches are sorted, then the requested page is
+returned along with the total number of matches. Each record is filtered
+for the caller before the predicates and sort are applied, persons by the
+consents of the caller as GetAllPersons does, so a search can't match or
+order on a field the caller can't see.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Predicate operators
+const (
+	searchEq     = "eq"
+	searchPrefix = "prefix"
+	searchRange  = "range"
+)
+
+var defaultSearchLimit = 50
+var maxSearchLimit = 500
+
+// Fields a search can filter and sort on, by json name
+var personSearchFields = map[string]func(Person) string{
+	"state":        func(p Person) string { return p.State },
+	"postcode":     func(p Person) string { return p.Postcode },
+	"city":         func(p Person) string { return p.City },
+	"registrator":  func(p Person) string { return p.Registrator },
+	"registerDate": func(p Person) string { return string(p.RegisterDate) },
+}
+
+var companySearchFields = map[string]func(Company) string{
+	"state":        func(c Company) string { return c.State },
+	"postcode":     func(c Company) string { return c.Postcode },
+	"city":         func(c Company) string { return c.City },
+	"regState":     func(c Company) string { return c.RegState },
+	"registrator":  func(c Company) string { return c.Registrator },
+	"registerDate": func(c Company) string { return string(c.RegisterDate) },
+}
+
+// Fields holding dates, which range over and sort by time
+var dateSearchFields = map[string]bool{"registerDate": true}
+
+// SearchPredicate is one condition of a search. Value is used by eq and
+// prefix, From and To by range; either end of a range can be left open.
+type SearchPredicate struct {
+	Field string `json:"field"`
+	Op    string `json:"op"`
+	Value string `json:"value,omitempty"`
+	From  string `json:"from,omitempty"`
+	To    string `json:"to,omitempty"`
+}
+
+// SearchQuery is the argument of the Search query
+type SearchQuery struct {
+	Type       string            `json:"type"`
+	Predicates []SearchPredicate `json:"predicates"`
+	Status     string            `json:"status,omitempty"`
+	SortBy     string            `json:"sortBy,omitempty"`
+	Descending bool              `json:"descending,omitempty"`
+	Offset     int               `json:"offset,omitempty"`
+	Limit      int               `json:"limit,omitempty"`
+}
+
+// SearchResult is one page of the matches of a search
+type SearchResult struct {
+	Total     int       `json:"total"`
+	Offset    int       `json:"offset"`
+	Limit     int       `json:"limit"`
+	Persons   []Person  `json:"persons,omitempty"`
+	Companies []Company `json:"companies,omitempty"`
+}
+
+// compiledPredicate is a predicate checked and ready to match values
+type compiledPredicate struct {
+	SearchPredicate
+	from time.Time
+	to   time.Time
+}
+
+func normaliseSearchText(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+func compilePredicate(p SearchPredicate, isField func(string) bool) (compiledPredicate, error) {
+	c := compiledPredicate{SearchPredicate: p}
+	if !isField(p.Field) {
+		return c, errors.New("Can't search on field " + p.Field)
+	}
+
+	switch p.Op {
+	case searchEq, searchPrefix:
+		if p.Value == "" {
+			return c, errors.New("The " + p.Op + " predicate on " + p.Field + " needs a value")
+		}
+	case searchRange:
+		if !dateSearchFields[p.Field] {
+			return c, errors.New("Field " + p.Field + " is not a date, it can't be searched by range")
+		}
+		if p.From == "" && p.To == "" {
+			return c, errors.New("The range predicate on " + p.Field + " needs a from or a to date")
+		}
+		var err error
+		if p.From != "" {
+			c.from, err = parseDate(p.From)
+			if err != nil {
+				return c, err
+			}
+		}
+		if p.To != "" {
+			c.to, err = parseDate(p.To)
+			if err != nil {
+				return c, err
+			}
+			// A plain date covers its whole day
+			if len(p.To) == len("2006-01-02") {
+				c.to = c.to.AddDate(0, 0, 1).Add(-time.Nanosecond)
+			}
+		}
+	default:
+		return c, errors.New("Unknown search operator " + p.Op + ", expecting eq, prefix or range")
+	}
+	return c, nil
+}
+
+func (c compiledPredicate) matches(value string) bool {
+	switch c.Op {
+	case searchEq:
+		return normaliseSearchText(value) == normaliseSearchText(c.Value)
+	case searchPrefix:
+		return strings.HasPrefix(normaliseSearchText(value), normaliseSearchText(c.Value))
+	case searchRange:
+		t, err := parseDate(value)
+		if err != nil {
+			return false
+		}
+		return (c.from.IsZero() || !t.Before(c.from)) && (c.to.IsZero() || !t.After(c.to))
+	}
+	return false
+}
+
+// searchLess orders two values of a sort field
+func searchLess(field string, a string, b string) bool {
+	if dateSearchFields[field] {
+		ta, errA := parseDate(a)
+		tb, errB := parseDate(b)
+		if errA == nil && errB == nil {
+			return ta.Before(tb)
+		}
+		// Unparseable dates sort last
+		if errA == nil || errB == nil {
+			return errA == nil
+		}
+	}
+	return normaliseSearchText(a) < normaliseSearchText(b)
+}
+
+// page returns the start and end of the requested page of total matches
+func (q SearchQuery) page(total int) (int, int) {
+	start := q.Offset
+	if start > total {
+		start = total
+	}
+	end := start + q.Limit
+	if end > total {
+		end = total
+	}
+	return start, end
+}
+
+// Search finds the persons or companies matching every predicate of a query
+func Search(stub *shim.ChaincodeStub, sQuery string) (SearchResult, error) {
+	var result SearchResult
+	var query SearchQuery
+
+	err := json.Unmarshal([]byte(sQuery), &query)
+	if err != nil {
+		return result, errors.New("Invalid search query")
+	}
+	if query.Offset < 0 {
+		return result, errors.New("Offset can't be negative")
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultSearchLimit
+	}
+	if query.Limit < 0 || query.Limit > maxSearchLimit {
+		return result, errors.New("Limit must be between 1 and 500")
+	}
+	if query.Status != "" && !isKnownStatus(query.Status) {
+		return result, errors.New("Unknown status " + query.Status)
+	}
+	if query.SortBy == "" {
+		query.SortBy = "registerDate"
+	}
+
+	if query.Type == ownerTypePerson {
+		return searchPersons(stub, query)
+	} else if query.Type == ownerTypeCompany {
+		return searchCompanies(stub, query)
+	}
+	return result, errors.New("Unknown search type " + query.Type + ", expecting person or company")
+}
+
+func searchPersons(stub *shim.ChaincodeStub, query SearchQuery) (SearchResult, error) {
+	var result SearchResult
+	isField := func(f string) bool { _, ok := personSearchFields[f]; return ok }
+
+	if !isField(query.SortBy) {
+		return result, errors.New("Can't sort on field " + query.SortBy)
+	}
+	var predicates []compiledPredicate
+	for _, p := range query.Predicates {
+		c, err := compilePredicate(p, isField)
+		if err != nil {
+			return result, err
+		}
+		predicates = append(predicates, c)
+	}
+
+	persons, err := GetAllPersons(stub, query.Status)
+	if err != nil {
+		return result, err
+	}
+	var matches []Person
+	for _, person := range persons {
+		// Only match on what the caller has consent for
+		person, err = filterPersonByConsent(stub, person)
+		if err != nil {
+			return result, err
+		}
+		matched := true
+		for _, c := range predicates {
+			if !c.matches(personSearchFields[c.Field](person)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			matches = append(matches, person)
+		}
+	}
+
+	sortValue := personSearchFields[query.SortBy]
+	sort.SliceStable(matches, func(i, j int) bool {
+		a, b := sortValue(matches[i]), sortValue(matches[j])
+		if a == b {
+			return matches[i].ID < matches[j].ID
+		}
+		if query.Descending {
+			return searchLess(query.SortBy, b, a)
+		}
+		return searchLess(query.SortBy, a, b)
+	})
+
+	start, end := query.page(len(matches))
+	result = SearchResult{Total: len(matches), Offset: start, Limit: query.Limit, Persons: matches[start:end]}
+	return result, nil
+}
+
+func searchCompanies(stub *shim.ChaincodeStub, query SearchQuery) (SearchResult, error) {
+	var result SearchResult
+	isField := func(f string) bool { _, ok := companySearchFields[f]; return ok }
+
+	if !isField(query.SortBy) {
+		return result, errors.New("Can't sort on field " + query.SortBy)
+	}
+	var predicates []compiledPredicate
+	for _, p := range query.Predicates {
+		c, err := compilePredicate(p, isField)
+		if err != nil {
+			return result, err
+		}
+		predicates = append(predicates, c)
+	}
+
+	companies, err := GetAllCompanies(stub, query.Status)
+	if err != nil {
+		return result, err
+	}
+	var matches []Company
+	for _, company := range companies {
+		company = filterCompany(stub, company)
+		matched := true
+		for _, c := range predicates {
+			if !c.matches(companySearchFields[c.Field](company)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			matches = append(matches, company)
+		}
+	}
+
+	sortValue := companySearchFields[query.SortBy]
+	sort.SliceStable(matches, func(i, j int) bool {
+		a, b := sortValue(matches[i]), sortValue(matches[j])
+		if a == b {
+			return matches[i].ID < matches[j].ID
+		}
+		if query.Descending {
+			return searchLess(query.SortBy, b, a)
+		}
+		return searchLess(query.SortBy, a, b)
+	})
+
+	start, end := query.page(len(matches))
+	result = SearchResult{Total: len(matches), Offset: start, Limit: query.Limit, Companies: matches[start:end]}
+	return result, nil
+}
@@ -0,0 +1,59 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: secrets held by the peers rather than the ledger
+
+Anything written to world state or passed as a transaction argument can be
+read by whoever can read the ledger, so secrets are configured on each peer.
+Every validating peer must be given the same values, or they will compute
+different state and fail consensus.
+
+IDMAN_HASH_KEY keys the hashes of low-entropy personal data, such as claims
+and identifiers, so they can't be reversed by trying every possible value.
+
+IDMAN_ATTEST_SEED is the base64 ed25519 seed attestations are signed with. The
+ledger holds only its public key, see attestation.go.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+)
+
+// Environment variable holding the key of keyedHash
+var hashKeyEnv = "IDMAN_HASH_KEY"
+
+var hashKey = os.Getenv(hashKeyEnv)
+
+// Environment variable holding the attestation signing seed
+var attestSeedEnv = "IDMAN_ATTEST_SEED"
+
+var attestSeed = os.Getenv(attestSeedEnv)
+
+// keyedHash returns the hex HMAC-SHA256 of a value under the peer's hash key.
+// The purpose keeps hashes made for different uses apart.
+func keyedHash(purpose string, value string) (string, error) {
+	if hashKey == "" {
+		return "", errors.New(hashKeyEnv + " is not set on this peer")
+	}
+	mac := hmac.New(sha256.New, []byte(hashKey))
+	mac.Write([]byte(purpose + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
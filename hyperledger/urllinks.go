@@ -0,0 +1,192 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: typed and validated UrlLinks of Person and Company records
+
+Every link has one of the known link types and an absolute http or https URL
+with a host. A record can't hold the same URL twice; URLs are compared with
+the scheme and host lower-cased and without a trailing slash. Links saved
+before link types existed are kept as they are. Only admins can add or
+remove links.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/IBM-Blockchain/cp-chaincode-v2/hyperledger/idcheck"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Link types of a UrlLink, shared with idman-csv
+var knownLinkTypes = idcheck.KnownLinkTypes
+
+// parseUrlLink checks the type and URL of a link and returns the canonical
+// URL, see idcheck.ParseLink
+func parseUrlLink(link UrlLink) (string, error) {
+	return idcheck.ParseLink(link.Url, link.UrlType)
+}
+
+// linkIndex returns the position of the link with the given canonical URL,
+// or -1. Links that don't parse only match on their exact URL.
+func linkIndex(links []UrlLink, canonical string) int {
+	for i, link := range links {
+		u, err := url.Parse(strings.TrimSpace(link.Url))
+		if (err == nil && idcheck.CanonicalURL(u) == canonical) || link.Url == canonical {
+			return i
+		}
+	}
+	return -1
+}
+
+// validateUrlLinks checks the links a record is registered with
+func validateUrlLinks(links []UrlLink) error {
+	var checked []UrlLink
+	for _, link := range links {
+		canonical, err := parseUrlLink(link)
+		if err != nil {
+			return err
+		}
+		if linkIndex(checked, canonical) >= 0 {
+			return errors.New("Duplicate link " + link.Url)
+		}
+		checked = append(checked, link)
+	}
+	return nil
+}
+
+// updateUrlLinks applies change to the links of a person or company and
+// saves the record
+func updateUrlLinks(stub *shim.ChaincodeStub, subjectType string, subjectID string, change func([]UrlLink) ([]UrlLink, error)) error {
+	var recordBytes []byte
+	var key string
+
+	if subjectType == ownerTypePerson {
+		person, err := GetPerson(subjectID, stub)
+		if err != nil {
+			return errors.New("Person " + subjectID + " not found")
+		}
+		if person.Status == statusErased {
+			return errors.New("Person " + subjectID + " has been erased")
+		}
+		person.UrlLinks, err = change(person.UrlLinks)
+		if err != nil {
+			return err
+		}
+		key = personPrefix + person.ID
+		recordBytes, err = json.Marshal(&person)
+		if err != nil {
+			fmt.Println("Error marshalling person")
+			return errors.New("Error updating links of person " + subjectID)
+		}
+	} else if subjectType == ownerTypeCompany {
+		company, err := GetCompany(subjectID, stub)
+		if err != nil {
+			return errors.New("Company " + subjectID + " not found")
+		}
+		company.UrlLinks, err = change(company.UrlLinks)
+		if err != nil {
+			return err
+		}
+		key = companyPrefix + company.ID
+		recordBytes, err = json.Marshal(&company)
+		if err != nil {
+			fmt.Println("Error marshalling company")
+			return errors.New("Error updating links of company " + subjectID)
+		}
+	} else {
+		return errors.New("Unknown subject type " + subjectType + ", expecting person or company")
+	}
+
+	err := stub.PutState(key, recordBytes)
+	if err != nil {
+		fmt.Println("Error writing " + key)
+		return errors.New("Error updating links of " + subjectType + " " + subjectID)
+	}
+	return nil
+}
+
+func (t *SimpleChaincode) addUrlLink(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	/*		0				1			2		3
+			"person"		"id"		"url"	"urlType"
+	*/
+	if len(args) != 4 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting subject type, ID, URL and link type")
+	}
+	_, err := checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	link := UrlLink{Url: strings.TrimSpace(args[2]), UrlType: args[3]}
+	canonical, err := parseUrlLink(link)
+	if err != nil {
+		return nil, err
+	}
+
+	err = updateUrlLinks(stub, args[0], args[1], func(links []UrlLink) ([]UrlLink, error) {
+		if linkIndex(links, canonical) >= 0 {
+			return nil, errors.New("Duplicate link " + link.Url)
+		}
+		return append(links, link), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Added " + link.UrlType + " link to " + args[0] + " " + args[1])
+	return nil, nil
+}
+
+func (t *SimpleChaincode) removeUrlLink(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	/*		0				1			2
+			"person"		"id"		"url"
+	*/
+	if len(args) != 3 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting subject type, ID and URL")
+	}
+	_, err := checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	canonical := strings.TrimSpace(args[2])
+	if u, err := url.Parse(canonical); err == nil {
+		canonical = idcheck.CanonicalURL(u)
+	}
+
+	err = updateUrlLinks(stub, args[0], args[1], func(links []UrlLink) ([]UrlLink, error) {
+		i := linkIndex(links, canonical)
+		if i < 0 {
+			return nil, errors.New("No link " + args[2] + " to remove")
+		}
+		return append(links[:i], links[i+1:]...), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Removed link " + args[2] + " from " + args[0] + " " + args[1])
+	return nil, nil
+}
@@ -0,0 +1,56 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestValidateUrlLinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		links   []UrlLink
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"distinct", []UrlLink{{Url: "https://a.com", UrlType: "website"}, {Url: "https://b.com", UrlType: "document"}}, false},
+		{"same URL in another case", []UrlLink{{Url: "https://a.com/", UrlType: "website"}, {Url: "HTTPS://A.COM", UrlType: "document"}}, true},
+		{"path case matters", []UrlLink{{Url: "https://a.com/X", UrlType: "website"}, {Url: "https://a.com/x", UrlType: "website"}}, false},
+		{"unknown type", []UrlLink{{Url: "https://a.com", UrlType: "blog"}}, true},
+		{"user info", []UrlLink{{Url: "https://u:p@a.com", UrlType: "website"}}, true},
+		{"linkedin elsewhere", []UrlLink{{Url: "https://evil.com/in/jon", UrlType: "linkedin"}}, true},
+	}
+	for _, tt := range tests {
+		err := validateUrlLinks(tt.links)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateUrlLinks = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLinkIndex(t *testing.T) {
+	links := []UrlLink{{Url: "https://A.com/", UrlType: "website"}, {Url: "::bad", UrlType: "document"}}
+	tests := []struct {
+		canonical string
+		want      int
+	}{
+		{"https://a.com", 0},
+		{"::bad", 1},
+		{"https://b.com", -1},
+	}
+	for _, tt := range tests {
+		if got := linkIndex(links, tt.canonical); got != tt.want {
+			t.Errorf("linkIndex(%q) = %d, want %d", tt.canonical, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: field by field verification of Person and Company claims
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var verifyPolicyPrefix = "VerifyPolicy:"
+
+// Outcome of comparing one claimed field with the registry
+const (
+	outcomeMatched     = "matched"
+	outcomeMismatched  = "mismatched"
+	outcomeNotSupplied = "not_supplied"
+)
+
+// FieldMatch is the outcome of comparing one claimed field
+type FieldMatch struct {
+	Field     string  `json:"field"`
+	Outcome   string  `json:"outcome"`
+	Mandatory bool    `json:"mandatory"`
+	Weight    float64 `json:"weight"`
+	// Similarity of the normalised values, for fields compared fuzzily
+	Similarity float64 `json:"similarity,omitempty"`
+}
+
+// VerificationReport is the result of VerifyPerson and VerifyCompany. The
+// verified company record is included when the verification passed. Person
+// records are never returned, so verifying a person discloses no other PII.
+type VerificationReport struct {
+	SubjectType string       `json:"subjectType"`
+	SubjectID   string       `json:"subjectId"`
+	Passed      bool         `json:"passed"`
+	Score       float64      `json:"score"`
+	Threshold   float64      `json:"threshold"`
+	Fields      []FieldMatch `json:"fields"`
+	Company     *Company     `json:"company,omitempty"`
+}
+
+// VerificationPolicy decides which fields must match and how much each field
+// counts towards the score. A verification passes when every mandatory field
+// matched and the score is at least Threshold. Free-text fields match when
+// their similarity is at least FuzzyThreshold (0 means the default).
+type VerificationPolicy struct {
+	SubjectType    string             `json:"subjectType"`
+	Mandatory      []string           `json:"mandatory"`
+	Weights        map[string]float64 `json:"weights"`
+	Threshold      float64            `json:"threshold"`
+	FuzzyThreshold float64            `json:"fuzzyThreshold"`
+}
+
+// Fields of a Person that can be verified, by json name
+var personVerifyFields = map[string]func(Person) string{
+	"firstName":      func(p Person) string { return p.FirstName },
+	"lastName":       func(p Person) string { return p.LastName },
+	"email":          func(p Person) string { return p.Email },
+	"birthDate":      func(p Person) string { return string(p.BirthDate) },
+	"gender":         func(p Person) string { return p.Gender },
+	"drivingLicence": func(p Person) string { return p.DrivingLicence },
+	"tfn":            func(p Person) string { return p.TFN },
+	"address":        func(p Person) string { return p.Address },
+	"city":           func(p Person) string { return p.City },
+	"postcode":       func(p Person) string { return p.Postcode },
+	"state":          func(p Person) string { return p.State },
+}
+
+// Fields of a Company that can be verified, by json name
+var companyVerifyFields = map[string]func(Company) string{
+	"name":     func(c Company) string { return c.Name },
+	"acn":      func(c Company) string { return c.ACN },
+	"abn":      func(c Company) string { return c.ABN },
+	"regDate":  func(c Company) string { return string(c.RegDate) },
+	"regState": func(c Company) string { return c.RegState },
+	"address":  func(c Company) string { return c.Address },
+	"city":     func(c Company) string { return c.City },
+	"postcode": func(c Company) string { return c.Postcode },
+	"state":    func(c Company) string { return c.State },
+}
+
+// Field order used in reports
+var personVerifyOrder = []string{"firstName", "lastName", "email", "birthDate", "gender", "drivingLicence", "tfn", "address", "city", "postcode", "state"}
+var companyVerifyOrder = []string{"name", "acn", "abn", "regDate", "regState", "address", "city", "postcode", "state"}
+
+// Free-text fields compared fuzzily. Every other field, in particular
+// identifiers such as TFN, ABN and ACN, must match exactly.
+var fuzzyVerifyFields = map[string]bool{
+	"firstName": true,
+	"lastName":  true,
+	"name":      true,
+	"address":   true,
+	"city":      true,
+}
+
+// Policies used until setVerificationPolicy is called. The mandatory fields are
+// the ones VerifyPerson and VerifyCompany have always checked.
+func defaultVerificationPolicy(subjectType string) VerificationPolicy {
+	if subjectType == ownerTypePerson {
+		return VerificationPolicy{SubjectType: ownerTypePerson, Mandatory: []string{"email", "birthDate", "drivingLicence"}}
+	}
+	return VerificationPolicy{SubjectType: ownerTypeCompany, Mandatory: []string{"regDate", "regState", "acn", "abn"}}
+}
+
+func (p VerificationPolicy) isMandatory(field string) bool {
+	for _, f := range p.Mandatory {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (p VerificationPolicy) fuzzyThreshold() float64 {
+	if p.FuzzyThreshold > 0 {
+		return p.FuzzyThreshold
+	}
+	return defaultFuzzyThreshold
+}
+
+func (p VerificationPolicy) weight(field string) float64 {
+	if w, ok := p.Weights[field]; ok {
+		return w
+	}
+	return 1.0
+}
+
+// GetVerificationPolicy returns the policy in force for persons or companies
+func GetVerificationPolicy(stub *shim.ChaincodeStub, subjectType string) (VerificationPolicy, error) {
+	var policy VerificationPolicy
+
+	if subjectType != ownerTypePerson && subjectType != ownerTypeCompany {
+		return policy, errors.New("Unknown subject type " + subjectType + ", expecting person or company")
+	}
+
+	policyBytes, err := stub.GetState(verifyPolicyPrefix + subjectType)
+	if err != nil {
+		fmt.Println("Error retrieving verification policy for " + subjectType)
+		return policy, errors.New("Error retrieving verification policy for " + subjectType)
+	}
+	if policyBytes == nil {
+		return defaultVerificationPolicy(subjectType), nil
+	}
+
+	err = json.Unmarshal(policyBytes, &policy)
+	if err != nil {
+		fmt.Println("Error unmarshalling verification policy for " + subjectType)
+		return policy, errors.New("Error unmarshalling verification policy for " + subjectType)
+	}
+	return policy, nil
+}
+
+func (t *SimpleChaincode) setVerificationPolicy(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+
+	/*		0
+			json
+			{
+				"subjectType": "person",
+				"mandatory": ["email", "birthDate"],
+				"weights": {"email": 2, "address": 0.5},
+				"threshold": 0.8
+			}
+	*/
+	if len(args) != 1 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting verification policy")
+	}
+	_, err := checkAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy VerificationPolicy
+	err = json.Unmarshal([]byte(args[0]), &policy)
+	if err != nil {
+		fmt.Println("error invalid verification policy")
+		return nil, errors.New("Invalid verification policy")
+	}
+
+	var known func(string) bool
+	if policy.SubjectType == ownerTypePerson {
+		known = func(f string) bool { _, ok := personVerifyFields[f]; return ok }
+	} else if policy.SubjectType == ownerTypeCompany {
+		known = func(f string) bool { _, ok := companyVerifyFields[f]; return ok }
+	} else {
+		return nil, errors.New("Unknown subject type " + policy.SubjectType + ", expecting person or company")
+	}
+
+	// A policy must not let a verification pass on nothing
+	if len(policy.Mandatory) == 0 {
+		return nil, errors.New("A verification policy needs at least one mandatory field")
+	}
+	for _, f := range policy.Mandatory {
+		if !known(f) {
+			return nil, errors.New("Field " + f + " can't be verified for a " + policy.SubjectType)
+		}
+	}
+	for f, w := range policy.Weights {
+		if !known(f) {
+			return nil, errors.New("Field " + f + " can't be verified for a " + policy.SubjectType)
+		}
+		if w < 0 {
+			return nil, errors.New("Weight of field " + f + " can't be negative")
+		}
+	}
+	if policy.Threshold <= 0 || policy.Threshold > 1 {
+		return nil, errors.New("Threshold must be above 0 and at most 1")
+	}
+	if policy.FuzzyThreshold < 0 || policy.FuzzyThreshold > 1 {
+		return nil, errors.New("Fuzzy threshold must be between 0 and 1")
+	}
+
+	policyBytes, err := json.Marshal(&policy)
+	if err != nil {
+		fmt.Println("Error marshalling verification policy")
+		return nil, errors.New("Error setting verification policy")
+	}
+	err = stub.PutState(verifyPolicyPrefix+policy.SubjectType, policyBytes)
+	if err != nil {
+		fmt.Println("Error writing verification policy")
+		return nil, errors.New("Error setting verification policy")
+	}
+
+	fmt.Println("Verification policy set for " + policy.SubjectType)
+	return nil, nil
+}
+
+// compareFields builds the per-field report of claimed against registered
+// values and scores it against the policy
+func compareFields(policy VerificationPolicy, order []string, claimed map[string]string, registered map[string]string) VerificationReport {
+	var report VerificationReport
+	var matchedWeight, consideredWeight float64
+
+	report.Passed = true
+	report.Threshold = policy.Threshold
+	for _, field := range order {
+		match := FieldMatch{Field: field, Mandatory: policy.isMandatory(field), Weight: policy.weight(field)}
+
+		if claimed[field] == "" {
+			match.Outcome = outcomeNotSupplied
+		} else if fuzzyVerifyFields[field] {
+			match.Similarity = textSimilarity(claimed[field], registered[field])
+			if match.Similarity >= policy.fuzzyThreshold() {
+				match.Outcome = outcomeMatched
+			} else {
+				match.Outcome = outcomeMismatched
+			}
+		} else if claimed[field] == registered[field] {
+			match.Outcome = outcomeMatched
+		} else {
+			match.Outcome = outcomeMismatched
+		}
+
+		if match.Outcome == outcomeMatched {
+			matchedWeight += match.Weight
+		}
+		if match.Outcome != outcomeNotSupplied || match.Mandatory {
+			consideredWeight += match.Weight
+		}
+		if match.Mandatory && match.Outcome != outcomeMatched {
+			report.Passed = false
+		}
+
+		report.Fields = append(report.Fields, match)
+	}
+
+	if consideredWeight > 0 {
+		report.Score = matchedWeight / consideredWeight
+	}
+	if report.Score < policy.Threshold {
+		report.Passed = false
+	}
+	return report
+}
+
+// comparePerson reports which claimed fields of a person match the registry
+func comparePerson(stub *shim.ChaincodeStub, claimed Person, registered Person) (VerificationReport, error) {
+	policy, err := GetVerificationPolicy(stub, ownerTypePerson)
+	if err != nil {
+		return VerificationReport{}, err
+	}
+
+	claimedValues := map[string]string{}
+	registeredValues := map[string]string{}
+	for field, value := range personVerifyFields {
+		claimedValues[field] = value(claimed)
+		registeredValues[field] = value(registered)
+	}
+
+	report := compareFields(policy, personVerifyOrder, claimedValues, registeredValues)
+	report.SubjectType = ownerTypePerson
+	report.SubjectID = registered.ID
+	return report, nil
+}
+
+// compareCompany reports which claimed fields of a company match the registry
+func compareCompany(stub *shim.ChaincodeStub, claimed Company, registered Company) (VerificationReport, error) {
+	policy, err := GetVerificationPolicy(stub, ownerTypeCompany)
+	if err != nil {
+		return VerificationReport{}, err
+	}
+
+	claimedValues := map[string]string{}
+	registeredValues := map[string]string{}
+	for field, value := range companyVerifyFields {
+		claimedValues[field] = value(claimed)
+		registeredValues[field] = value(registered)
+	}
+
+	report := compareFields(policy, companyVerifyOrder, claimedValues, registeredValues)
+	report.SubjectType = ownerTypeCompany
+	report.SubjectID = registered.ID
+	if report.Passed {
+		visible := filterCompany(stub, registered)
+		report.Company = &visible
+	}
+	return report, nil
+}
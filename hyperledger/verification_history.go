@@ -0,0 +1,211 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: on-ledger audit trail of verifications
+
+The verifier is the enrollment ID of the caller. The submitted claims are kept
+only as a keyed hash, see secrets.go. Only verifications of registered persons
+and companies are recorded, and their history is for the subject, its
+registrator or an admin.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var verificationPrefix = "verif:"
+var verificationKeysPrefix = "VerifKeys:"
+
+// VerificationRecord is the audit entry written by the verifyPerson and
+// verifyCompany invokes. It holds a hash of the submitted claims, never the
+// claims themselves.
+type VerificationRecord struct {
+	ID          string       `json:"id"`
+	Verifier    string       `json:"verifier"`
+	SubjectType string       `json:"subjectType"`
+	SubjectID   string       `json:"subjectId"`
+	ClaimsHash  string       `json:"claimsHash"`
+	Passed      bool         `json:"passed"`
+	Score       float64      `json:"score"`
+	Fields      []FieldMatch `json:"fields"`
+	Error       string       `json:"error,omitempty"`
+	Timestamp   string       `json:"timestamp"`
+	// Attestation issued for a passed verification, if an attestation key is set
+	AttestationID string `json:"attestationId,omitempty"`
+}
+
+// hashClaims returns the keyed hash of the submitted claims. The claims are
+// re-marshalled first so that key order and whitespace don't change the hash.
+func hashClaims(claims string) (string, error) {
+	var parsed map[string]interface{}
+	err := json.Unmarshal([]byte(claims), &parsed)
+	if err != nil {
+		return "", errors.New("Error unmarshalling claims")
+	}
+	canonical, err := json.Marshal(parsed)
+	if err != nil {
+		return "", errors.New("Error marshalling claims")
+	}
+	return keyedHash("claims", string(canonical))
+}
+
+func (t *SimpleChaincode) verifyPerson(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.recordVerification(stub, ownerTypePerson, args)
+}
+
+func (t *SimpleChaincode) verifyCompany(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.recordVerification(stub, ownerTypeCompany, args)
+}
+
+// recordVerification runs VerifyPerson or VerifyCompany and writes the outcome
+// to the ledger. Failed verifications are recorded as well, so the invoke only
+// fails when nothing can be recorded.
+func (t *SimpleChaincode) recordVerification(stub *shim.ChaincodeStub, subjectType string, args []string) ([]byte, error) {
+
+	/*		0
+			json claims
+	*/
+	if len(args) != 1 {
+		fmt.Println("error invalid arguments")
+		return nil, errors.New("Incorrect number of arguments. Expecting claims")
+	}
+	verifier, err := callerID(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	claimsHash, err := hashClaims(args[0])
+	if err != nil {
+		fmt.Println("Error hashing claims")
+		return nil, err
+	}
+
+	var report VerificationReport
+	var verifyErr error
+	if subjectType == ownerTypePerson {
+		report, verifyErr = VerifyPerson(stub, args[0])
+	} else {
+		report, verifyErr = VerifyCompany(stub, args[0])
+	}
+	// Only a registered subject has anything to file the record under, so no
+	// caller can fill the ledger with records of made-up IDs
+	registered := report.SubjectID != ""
+	if registered && subjectType == ownerTypePerson {
+		_, err = GetPerson(report.SubjectID, stub)
+		registered = err == nil
+	} else if registered {
+		_, err = GetCompany(report.SubjectID, stub)
+		registered = err == nil
+	}
+	if !registered {
+		fmt.Println("Error verifying " + subjectType)
+		if verifyErr == nil {
+			verifyErr = errors.New("Unknown " + subjectType + " " + report.SubjectID)
+		}
+		return nil, verifyErr
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	listKey := verificationKeysPrefix + subjectType + ":" + report.SubjectID
+	keys, err := getKeyList(stub, listKey)
+	if err != nil {
+		return nil, err
+	}
+
+	record := VerificationRecord{
+		ID:          verificationPrefix + subjectType + ":" + report.SubjectID + ":" + strconv.Itoa(len(keys)),
+		Verifier:    verifier,
+		SubjectType: subjectType,
+		SubjectID:   report.SubjectID,
+		ClaimsHash:  claimsHash,
+		Passed:      report.Passed,
+		Score:       report.Score,
+		Fields:      report.Fields,
+		Timestamp:   now.Format(time.RFC3339),
+	}
+	if verifyErr != nil {
+		record.Passed = false
+		record.Error = verifyErr.Error()
+	}
+	if record.Passed {
+		record.AttestationID, err = issueAttestation(stub, record)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	recordBytes, err := json.Marshal(&record)
+	if err != nil {
+		fmt.Println("Error marshalling verification record")
+		return nil, errors.New("Error recording verification")
+	}
+	err = stub.PutState(record.ID, recordBytes)
+	if err != nil {
+		fmt.Println("Error writing verification record")
+		return nil, errors.New("Error recording verification")
+	}
+	err = putKeyList(stub, listKey, append(keys, record.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Recorded verification " + record.ID)
+	return recordBytes, nil
+}
+
+// GetVerificationHistory returns every recorded verification of a person or
+// company, oldest first
+func GetVerificationHistory(stub *shim.ChaincodeStub, subjectType string, subjectID string) ([]VerificationRecord, error) {
+	var history []VerificationRecord
+
+	if subjectType != ownerTypePerson && subjectType != ownerTypeCompany {
+		return nil, errors.New("Unknown subject type " + subjectType + ", expecting person or company")
+	}
+
+	keys, err := getKeyList(stub, verificationKeysPrefix+subjectType+":"+subjectID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		recordBytes, err := stub.GetState(key)
+		if err != nil {
+			fmt.Println("Error retrieving verification record " + key)
+			return nil, errors.New("Error retrieving verification record " + key)
+		}
+
+		var record VerificationRecord
+		err = json.Unmarshal(recordBytes, &record)
+		if err != nil {
+			fmt.Println("Error unmarshalling verification record " + key)
+			return nil, errors.New("Error unmarshalling verification record " + key)
+		}
+		history = append(history, record)
+	}
+
+	return history, nil
+}
@@ -0,0 +1,546 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+ID-Man: CSV import and export for the identity registry
+
+	idman-csv import -type person [-map "Surname=lastName,..."] [-strict] [-skip-invalid] [-batch-size 1000] < persons.csv > payloads.json
+	idman-csv export -type company < companies.json > companies.csv
+
+import reads a CSV file with a header row and writes the chaincode calls for
+registerPersonsBatch or registerCompaniesBatch, as {"Function":...,"Args":[...]}
+one per line. The records are split into calls of at most -batch-size records,
+which can't be more than the chaincode takes in one batch. Each call is its
+own transaction, so -strict makes each call all or nothing, not the file.
+Header names are matched to the json field names of Person and Company,
+ignoring case, spaces and underscores; -map renames other headers. The
+urlLinks column holds "type=url" pairs separated by ";". Every row is checked
+with the date, link and ID checks of the chaincode, from the idcheck package,
+and all problems are reported by row number. What depends on the ledger, such
+as duplicates and the effective date window, is only checked on-chain.
+The id, status, photoDigest, registrator and registerDate columns written by
+export are set by the registry and ignored, so an exported file can be
+imported again. The registrator of the imported records is whoever submits
+the calls. Photos aren't imported: the chaincode takes only references to
+photos already in the photo store.
+
+The registry sets the register date to the transaction time and keeps an
+effectiveDate column as the effective date of the record. The effective date
+must lie within the effective date window around ledger time, which the
+GetEffectiveDateWindow query returns; it is 30 days back and none ahead until
+an admin changes it. The tool can't know the window, so a row outside it is
+only rejected by the chaincode.
+
+export reads the output of the GetAllPersons or GetAllCompanies query and
+writes it as CSV.
+
+The record types are copied from the chaincode, which is a main package and
+can't be imported. Keep them in step with hyperledger/cp_cc.go; the checks
+are shared through hyperledger/idcheck instead.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM-Blockchain/cp-chaincode-v2/hyperledger/idcheck"
+)
+
+type UrlLink struct {
+	Url     string `json:"url"`
+	UrlType string `json:"urlType"`
+}
+
+// Person holds the fields registerPerson takes
+type Person struct {
+	FirstName      string    `json:"firstName"`
+	LastName       string    `json:"lastName"`
+	Email          string    `json:"email"`
+	BirthDate      string    `json:"birthDate"`
+	Gender         string    `json:"gender"`
+	DrivingLicence string    `json:"drivingLicence"`
+	TFN            string    `json:"tfn"`
+	Address        string    `json:"address"`
+	City           string    `json:"city"`
+	Postcode       string    `json:"postcode"`
+	State          string    `json:"state"`
+	UrlLinks       []UrlLink `json:"urlLinks,omitempty"`
+	Registrator    string    `json:"registrator"`
+	RegisterDate   string    `json:"registerDate"`
+	EffectiveDate  string    `json:"effectiveDate,omitempty"`
+}
+
+// Company holds the fields registerCompany takes
+type Company struct {
+	Name          string    `json:"name"`
+	ACN           string    `json:"acn"`
+	ABN           string    `json:"abn"`
+	RegDate       string    `json:"regDate"`
+	RegState      string    `json:"regState"`
+	Address       string    `json:"address"`
+	City          string    `json:"city"`
+	Postcode      string    `json:"postcode"`
+	State         string    `json:"state"`
+	UrlLinks      []UrlLink `json:"urlLinks,omitempty"`
+	Registrator   string    `json:"registrator"`
+	RegisterDate  string    `json:"registerDate"`
+	EffectiveDate string    `json:"effectiveDate,omitempty"`
+}
+
+// PhotoRef is the on-ledger reference to a person's photo
+type PhotoRef struct {
+	Digest string `json:"digest"`
+}
+
+// Records as GetAllPersons and GetAllCompanies return them
+type personRecord struct {
+	ID     string    `json:"id"`
+	Status string    `json:"status"`
+	Photo  *PhotoRef `json:"photo"`
+	Person
+}
+
+type companyRecord struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Company
+}
+
+// maxBatchSize is the most records the chaincode registers in one batch
+var maxBatchSize = 1000
+
+// Columns export writes that the registry sets itself
+var serverColumns = map[string]bool{"id": true, "status": true, "photoDigest": true, "registrator": true, "registerDate": true}
+
+// Date fields, and whether they may be in the future. The effective date may
+// be ahead of ledger time if the effective date window allows it.
+var dateFields = map[string]bool{"birthDate": false, "regDate": false, "effectiveDate": true}
+
+// parseDate accepts the date forms the chaincode accepts, and like the
+// chaincode rejects dates in the future unless they are allowed
+func parseDate(s string, futureAllowed bool) error {
+	t, _, err := idcheck.ParseDate(s)
+	if err != nil {
+		return err
+	}
+	if !futureAllowed && t.After(time.Now().Add(idcheck.MaxClockSkew)) {
+		return errors.New("date " + s + " is in the future")
+	}
+	return nil
+}
+
+// jsonFields lists the json names of the fields of a record type, in order
+func jsonFields(t reflect.Type) []string {
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+func recordType(subjectType string) (reflect.Type, error) {
+	switch subjectType {
+	case "person":
+		return reflect.TypeOf(Person{}), nil
+	case "company":
+		return reflect.TypeOf(Company{}), nil
+	}
+	return nil, errors.New("unknown type " + subjectType + ", expecting person or company")
+}
+
+func headerKey(s string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "_", "", "-", "").Replace(strings.TrimSpace(s)))
+}
+
+// parseMapping reads "header=field,header=field"
+func parseMapping(s string) (map[string]string, error) {
+	mapping := map[string]string{}
+	if s == "" {
+		return mapping, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, errors.New("invalid mapping " + pair + ", expecting header=field")
+		}
+		mapping[headerKey(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return mapping, nil
+}
+
+// mapHeader returns the field of each column, blank for ignored columns
+func mapHeader(header []string, fields []string, mapping map[string]string) ([]string, error) {
+	byKey := map[string]string{}
+	for _, f := range fields {
+		byKey[headerKey(f)] = f
+	}
+	for k := range serverColumns {
+		byKey[headerKey(k)] = k
+	}
+
+	columns := make([]string, len(header))
+	seen := map[string]bool{}
+	for i, h := range header {
+		name, ok := mapping[headerKey(h)]
+		if ok {
+			if _, known := byKey[headerKey(name)]; !known {
+				return nil, errors.New("column " + h + " is mapped to unknown field " + name)
+			}
+			name = byKey[headerKey(name)]
+		} else if name, ok = byKey[headerKey(h)]; !ok {
+			return nil, errors.New("column " + h + " matches no field, map it with -map")
+		}
+		if serverColumns[name] {
+			continue
+		}
+		if seen[name] {
+			return nil, errors.New("more than one column holds " + name)
+		}
+		seen[name] = true
+		columns[i] = name
+	}
+	return columns, nil
+}
+
+// parseLinks reads "type=url;type=url"
+func parseLinks(s string) ([]UrlLink, error) {
+	var links []UrlLink
+	seen := map[string]bool{}
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("link " + item + " must be type=url")
+		}
+		link := UrlLink{UrlType: strings.TrimSpace(parts[0]), Url: strings.TrimSpace(parts[1])}
+
+		canonical, err := idcheck.ParseLink(link.Url, link.UrlType)
+		if err != nil {
+			return nil, err
+		}
+		if seen[canonical] {
+			return nil, errors.New("duplicate link " + link.Url)
+		}
+		seen[canonical] = true
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+func formatLinks(links []UrlLink) string {
+	var items []string
+	for _, link := range links {
+		items = append(items, link.UrlType+"="+link.Url)
+	}
+	return strings.Join(items, ";")
+}
+
+// checkRecord applies the checks the chaincode makes on registration that
+// don't depend on the ledger
+func checkRecord(subjectType string, values map[string]string) error {
+	if subjectType == "person" {
+		if idcheck.PersonID(values["firstName"], values["lastName"]) == "" {
+			return errors.New("Person ID cannot be blank, a firstName or lastName is required")
+		}
+	} else if idcheck.CompanyID(values["name"]) == "" {
+		return errors.New("company ID cannot be blank, a name is required")
+	}
+
+	for field, futureAllowed := range dateFields {
+		if values[field] != "" {
+			if err := parseDate(values[field], futureAllowed); err != nil {
+				return errors.New(field + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// rowRecord turns one CSV row into a record, checked against the struct
+func rowRecord(subjectType string, columns []string, row []string) (json.RawMessage, error) {
+	values := map[string]string{}
+	for i, field := range columns {
+		if field != "" && i < len(row) {
+			values[field] = strings.TrimSpace(row[i])
+		}
+	}
+	err := checkRecord(subjectType, values)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]interface{}{}
+	for field, value := range values {
+		if field == "urlLinks" {
+			links, err := parseLinks(value)
+			if err != nil {
+				return nil, err
+			}
+			if len(links) > 0 {
+				fields[field] = links
+			}
+		} else if value != "" {
+			fields[field] = value
+		}
+	}
+
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decoding into the record type catches fields of the wrong type
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if subjectType == "person" {
+		var p Person
+		err = dec.Decode(&p)
+		if err == nil {
+			raw, err = json.Marshal(&p)
+		}
+	} else {
+		var c Company
+		err = dec.Decode(&c)
+		if err == nil {
+			raw, err = json.Marshal(&c)
+		}
+	}
+	return raw, err
+}
+
+func importCSV(subjectType string, mapping map[string]string, strict bool, skipInvalid bool, batchSize int, in io.Reader, out io.Writer, log io.Writer) error {
+	t, err := recordType(subjectType)
+	if err != nil {
+		return err
+	}
+	if batchSize < 1 || batchSize > maxBatchSize {
+		return errors.New("batch size must be between 1 and " + strconv.Itoa(maxBatchSize))
+	}
+
+	r := csv.NewReader(in)
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return errors.New("reading header: " + err.Error())
+	}
+	columns, err := mapHeader(header, jsonFields(t), mapping)
+	if err != nil {
+		return err
+	}
+
+	var records []json.RawMessage
+	invalid := 0
+	for line := 2; ; line++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			var record json.RawMessage
+			record, err = rowRecord(subjectType, columns, row)
+			if err == nil {
+				records = append(records, record)
+				continue
+			}
+		}
+		invalid++
+		fmt.Fprintf(log, "row %d: %v\n", line, err)
+	}
+
+	if invalid > 0 && !skipInvalid {
+		return fmt.Errorf("%d invalid rows, fix them or pass -skip-invalid", invalid)
+	}
+	if len(records) == 0 {
+		return errors.New("no records to register")
+	}
+
+	function := "registerPersonsBatch"
+	if subjectType == "company" {
+		function = "registerCompaniesBatch"
+	}
+	payloads := 0
+	for start := 0; start < len(records); start += batchSize {
+		end := start + batchSize
+		if end > len(records) {
+			end = len(records)
+		}
+		batch, err := json.Marshal(records[start:end])
+		if err != nil {
+			return err
+		}
+		args := []string{string(batch)}
+		if strict {
+			args = append(args, "strict")
+		}
+
+		payload, err := json.Marshal(map[string]interface{}{"Function": function, "Args": args})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, string(payload))
+		if err != nil {
+			return err
+		}
+		payloads++
+	}
+	fmt.Fprintf(log, "%d records in %d calls, %d invalid rows skipped\n", len(records), payloads, invalid)
+	return nil
+}
+
+// recordRow flattens a record to the export columns
+func recordRow(record reflect.Value, fields []string) []string {
+	t := record.Type()
+	byName := map[string]reflect.Value{}
+	for i := 0; i < t.NumField(); i++ {
+		byName[strings.Split(t.Field(i).Tag.Get("json"), ",")[0]] = record.Field(i)
+	}
+
+	var row []string
+	for _, field := range fields {
+		row = append(row, formatValue(byName[field]))
+	}
+	return row
+}
+
+// formatValue writes one field of a record as a CSV cell. Missing fields and
+// nil pointers are blank.
+func formatValue(v reflect.Value) string {
+	if !v.IsValid() {
+		return ""
+	}
+	if links, ok := v.Interface().([]UrlLink); ok {
+		return formatLinks(links)
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	case reflect.Ptr, reflect.Slice, reflect.Map:
+		if v.IsNil() {
+			return ""
+		}
+	}
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func exportCSV(subjectType string, in io.Reader, out io.Writer) error {
+	t, err := recordType(subjectType)
+	if err != nil {
+		return err
+	}
+	fields := jsonFields(t)
+
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(out)
+
+	if subjectType == "person" {
+		var records []personRecord
+		err = json.Unmarshal(data, &records)
+		if err != nil {
+			return errors.New("expecting the output of GetAllPersons: " + err.Error())
+		}
+		w.Write(append(append([]string{"id"}, fields...), "status", "photoDigest"))
+		for _, r := range records {
+			digest := ""
+			if r.Photo != nil {
+				digest = r.Photo.Digest
+			}
+			w.Write(append(append([]string{r.ID}, recordRow(reflect.ValueOf(r.Person), fields)...), r.Status, digest))
+		}
+	} else {
+		var records []companyRecord
+		err = json.Unmarshal(data, &records)
+		if err != nil {
+			return errors.New("expecting the output of GetAllCompanies: " + err.Error())
+		}
+		w.Write(append(append([]string{"id"}, fields...), "status"))
+		for _, r := range records {
+			w.Write(append(append([]string{r.ID}, recordRow(reflect.ValueOf(r.Company), fields)...), r.Status))
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: idman-csv import -type person|company [-map header=field,...] [-strict] [-skip-invalid] [-batch-size n] < in.csv > payloads.json")
+	fmt.Fprintln(os.Stderr, "       idman-csv export -type person|company < getall.json > out.csv")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	subjectType := flags.String("type", "person", "record type, person or company")
+	var err error
+
+	switch os.Args[1] {
+	case "import":
+		mapFlag := flags.String("map", "", "rename CSV headers to fields, as header=field,header=field")
+		strict := flags.Bool("strict", false, "register all or nothing")
+		skipInvalid := flags.Bool("skip-invalid", false, "leave invalid rows out instead of failing")
+		batchSize := flags.Int("batch-size", maxBatchSize, "most records in one chaincode call")
+		flags.Parse(os.Args[2:])
+
+		var mapping map[string]string
+		mapping, err = parseMapping(*mapFlag)
+		if err == nil {
+			err = importCSV(*subjectType, mapping, *strict, *skipInvalid, *batchSize, os.Stdin, os.Stdout, os.Stderr)
+		}
+	case "export":
+		flags.Parse(os.Args[2:])
+		err = exportCSV(*subjectType, os.Stdin, os.Stdout)
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "idman-csv: "+err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,220 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckRecord(t *testing.T) {
+	tests := []struct {
+		subjectType string
+		values      map[string]string
+		wantErr     bool
+	}{
+		{"person", map[string]string{"firstName": "Jon", "lastName": "Smith"}, false},
+		{"person", map[string]string{"lastName": "Smith", "email": "not an email"}, false},
+		{"person", map[string]string{"firstName": " ", "lastName": ""}, true},
+		{"person", map[string]string{"firstName": "Jon", "birthDate": "1980-01-01"}, false},
+		{"person", map[string]string{"firstName": "Jon", "birthDate": "315532800000"}, false},
+		{"person", map[string]string{"firstName": "Jon", "birthDate": "19800101"}, true},
+		{"person", map[string]string{"firstName": "Jon", "birthDate": "2999-01-01"}, true},
+		{"person", map[string]string{"firstName": "Jon", "effectiveDate": "2999-01-01"}, false},
+		{"company", map[string]string{"name": "Acme"}, false},
+		{"company", map[string]string{"name": "  "}, true},
+		{"company", map[string]string{"name": "Acme", "regDate": "01/02/1990"}, true},
+	}
+	for _, tt := range tests {
+		err := checkRecord(tt.subjectType, tt.values)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkRecord(%s, %v) = %v, want error %v", tt.subjectType, tt.values, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseLinks(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []UrlLink
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "website=https://a.com", want: []UrlLink{{Url: "https://a.com", UrlType: "website"}}},
+		{in: " website = https://a.com ; document=https://b.com/x;", want: []UrlLink{{Url: "https://a.com", UrlType: "website"}, {Url: "https://b.com/x", UrlType: "document"}}},
+		{in: "website=https://a.com;document=HTTPS://A.COM/", wantErr: true},
+		{in: "https://a.com", wantErr: true},
+		{in: "blog=https://a.com", wantErr: true},
+		{in: "website=https://u:p@a.com", wantErr: true},
+		{in: "linkedin=https://evil.com/in/jon", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseLinks(tt.in)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseLinks(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestRowRecord(t *testing.T) {
+	columns := []string{"firstName", "", "lastName", "urlLinks"}
+	tests := []struct {
+		row     []string
+		want    string
+		wantErr bool
+	}{
+		{row: []string{" Jon ", "ignored", "Smith", ""}, want: `{"firstName":"Jon","lastName":"Smith","email":"","birthDate":"","gender":"","drivingLicence":"","tfn":"","address":"","city":"","postcode":"","state":"","registrator":"","registerDate":""}`},
+		{row: []string{"Jon", "", "Smith", "website=https://a.com"}, want: `{"firstName":"Jon","lastName":"Smith","email":"","birthDate":"","gender":"","drivingLicence":"","tfn":"","address":"","city":"","postcode":"","state":"","urlLinks":[{"url":"https://a.com","urlType":"website"}],"registrator":"","registerDate":""}`},
+		{row: []string{"Jon"}, want: `{"firstName":"Jon","lastName":"","email":"","birthDate":"","gender":"","drivingLicence":"","tfn":"","address":"","city":"","postcode":"","state":"","registrator":"","registerDate":""}`},
+		{row: []string{"", "", "", ""}, wantErr: true},
+		{row: []string{"Jon", "", "Smith", "website=ftp://a.com"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := rowRecord("person", columns, tt.row)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && string(got) != tt.want) {
+			t.Errorf("rowRecord(%q) = %s, %v, want %s", tt.row, got, err, tt.want)
+		}
+	}
+}
+
+func TestMapHeader(t *testing.T) {
+	fields := jsonFields(reflect.TypeOf(Person{}))
+	tests := []struct {
+		header  []string
+		mapping map[string]string
+		want    []string
+		wantErr bool
+	}{
+		{header: []string{"First Name", "last_name", "EMAIL"}, want: []string{"firstName", "lastName", "email"}},
+		{header: []string{"id", "firstName", "status", "registrator"}, want: []string{"", "firstName", "", ""}},
+		{header: []string{"Surname", "firstName"}, mapping: map[string]string{"surname": "lastName"}, want: []string{"lastName", "firstName"}},
+		{header: []string{"Surname"}, wantErr: true},
+		{header: []string{"Surname"}, mapping: map[string]string{"surname": "maidenName"}, wantErr: true},
+		{header: []string{"lastName", "last name"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := mapHeader(tt.header, fields, tt.mapping)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("mapHeader(%q) = %q, %v, want %q", tt.header, got, err, tt.want)
+		}
+	}
+}
+
+func TestImportCSVBatches(t *testing.T) {
+	rows := "firstName,lastName\nA,One\nB,Two\nC,Three\nD,Four\nE,Five\n"
+	tests := []struct {
+		name        string
+		in          string
+		strict      bool
+		skipInvalid bool
+		batchSize   int
+		wantSizes   []int
+		wantErr     bool
+	}{
+		{name: "one batch", in: rows, batchSize: 1000, wantSizes: []int{5}},
+		{name: "even batches", in: rows, batchSize: 5, wantSizes: []int{5}},
+		{name: "last batch short", in: rows, batchSize: 2, wantSizes: []int{2, 2, 1}},
+		{name: "one per batch", in: rows, batchSize: 1, wantSizes: []int{1, 1, 1, 1, 1}},
+		{name: "strict", in: rows, strict: true, batchSize: 3, wantSizes: []int{3, 2}},
+		{name: "batch too big", in: rows, batchSize: maxBatchSize + 1, wantErr: true},
+		{name: "batch size zero", in: rows, batchSize: 0, wantErr: true},
+		{name: "invalid row", in: rows + ",\n", batchSize: 2, wantErr: true},
+		{name: "invalid row skipped", in: rows + ",\n", skipInvalid: true, batchSize: 2, wantSizes: []int{2, 2, 1}},
+		{name: "no rows", in: "firstName,lastName\n", batchSize: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		var out, log bytes.Buffer
+		err := importCSV("person", nil, tt.strict, tt.skipInvalid, tt.batchSize, strings.NewReader(tt.in), &out, &log)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: importCSV = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+
+		var sizes []int
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var call struct {
+				Function string
+				Args     []string
+			}
+			if err := json.Unmarshal([]byte(line), &call); err != nil {
+				t.Fatalf("%s: payload %s: %v", tt.name, line, err)
+			}
+			wantArgs := 1
+			if tt.strict {
+				wantArgs = 2
+			}
+			if call.Function != "registerPersonsBatch" || len(call.Args) != wantArgs || (tt.strict && call.Args[1] != "strict") {
+				t.Errorf("%s: unexpected call %s", tt.name, line)
+				continue
+			}
+			var records []json.RawMessage
+			if err := json.Unmarshal([]byte(call.Args[0]), &records); err != nil {
+				t.Fatalf("%s: batch %s: %v", tt.name, call.Args[0], err)
+			}
+			sizes = append(sizes, len(records))
+		}
+		if !reflect.DeepEqual(sizes, tt.wantSizes) {
+			t.Errorf("%s: batch sizes %v, want %v", tt.name, sizes, tt.wantSizes)
+		}
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	var noPhoto *PhotoRef
+	tests := []struct {
+		v    reflect.Value
+		want string
+	}{
+		{reflect.Value{}, ""},
+		{reflect.ValueOf("Jon"), "Jon"},
+		{reflect.ValueOf(true), "true"},
+		{reflect.ValueOf(42), "42"},
+		{reflect.ValueOf(12.5), "12.5"},
+		{reflect.ValueOf(noPhoto), ""},
+		{reflect.ValueOf(&PhotoRef{Digest: "abc"}), `{"digest":"abc"}`},
+		{reflect.ValueOf([]UrlLink(nil)), ""},
+		{reflect.ValueOf([]UrlLink{{Url: "https://a.com", UrlType: "website"}, {Url: "https://b.com", UrlType: "document"}}), "website=https://a.com;document=https://b.com"},
+	}
+	for _, tt := range tests {
+		if got := formatValue(tt.v); got != tt.want {
+			t.Errorf("formatValue(%v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	in := `[{"id":"jonsmith","status":"active","photo":{"digest":"abc"},"firstName":"Jon","lastName":"Smith","birthDate":"1980-01-01","urlLinks":[{"url":"https://a.com","urlType":"website"}],"registrator":"reg1","registerDate":"2017-07-14T02:40:00.000Z"}]`
+	var csvOut bytes.Buffer
+	if err := exportCSV("person", strings.NewReader(in), &csvOut); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(csvOut.String(), "Value>") {
+		t.Errorf("export wrote a reflect placeholder:\n%s", csvOut.String())
+	}
+
+	var out, log bytes.Buffer
+	if err := importCSV("person", nil, false, false, 10, &csvOut, &out, &log); err != nil {
+		t.Fatalf("importing the export: %v\n%s", err, log.String())
+	}
+	if !strings.Contains(out.String(), `\"urlLinks\":[{\"url\":\"https://a.com\",\"urlType\":\"website\"}]`) {
+		t.Errorf("links lost in the round trip: %s", out.String())
+	}
+}